@@ -29,6 +29,7 @@ class Struct extends Component {
         fields: [],
         methods: [],
         searchTerm: '',
+        diffClass: () => '',
     };
 // Метод isHighlighted в компоненте Struct
     isHighlighted = (text) => {
@@ -88,7 +89,7 @@ class Struct extends Component {
             const TYPES = ['string', 'int', 'bool'];
             let typeClass = TYPES.indexOf(field.type.struct) !== -1 ? field.type.struct : 'other';
             return (
-                <li key={i} className={`field ${this.isHighlighted(field.name) || this.isHighlighted(field.type.literal) ? 'highlighted' : ''}`}>
+                <li key={i} className={`field ${this.isHighlighted(field.name) || this.isHighlighted(field.type.literal) ? 'highlighted' : ''} ${this.props.diffClass('field', field.name)}`}>
                 <span className='left'>
                     <span className='field icon' onClick={() => this.onRemoveField(i)}>
                         <span className='f'>f</span>
@@ -122,7 +123,7 @@ class Struct extends Component {
                     (method.returnType && method.returnType.some(type => this.isHighlighted(type.literal)))
                         ? 'highlighted'
                         : ''
-                }`}>
+                } ${this.props.diffClass('method', method.name)}`}>
                 <span className='left'>
                     <span className='method icon'>m</span>
                     {this.getInput({
@@ -38,6 +38,7 @@ class UMLDiagram extends Component {
       globalFunctions: []
     },
     miniMap: false,
+    diff: null,
   };
 
   componentDidUpdate(prevProps) {
@@ -59,6 +60,25 @@ class UMLDiagram extends Component {
     return searchTerm && text.toLowerCase().includes(searchTerm);
   }
 
+  // Returns the CSS class marking a struct, or one of its fields or methods
+  // when element and name are given, as added or changed by the current diff.
+  diffClass = (pkg, struct, element, name) => {
+    const { diff } = this.props;
+    if (!diff) {
+      return '';
+    }
+    const changes = diff.filter(change =>
+        change.package === pkg && change.type === struct && change.element !== 'edge');
+    if (element) {
+      const change = changes.find(c => c.element === element && c.name === name);
+      return change ? `diff-${change.kind}` : '';
+    }
+    if (changes.some(c => c.element === 'type' && c.kind === 'added')) {
+      return 'diff-added';
+    }
+    return changes.length > 0 ? 'diff-changed' : '';
+  }
+
   render() {
     const { data, miniMap } = this.props;
     const { isTransitioning, position, dragging, searchTerm } = this.state;
@@ -144,7 +164,7 @@ class UMLDiagram extends Component {
     return (
         <Struct
             key={`${pkg.name}-${file.name}-${struct.name}`}
-            className={`${this.getStructRef(pkg, file, struct)} ${this.isHighlighted(struct.name) ? 'highlighted' : ''}`}
+            className={`${this.getStructRef(pkg, file, struct)} ${this.isHighlighted(struct.name) ? 'highlighted' : ''} ${this.diffClass(pkg.name, struct.name)}`}
             package={pkg.name}
             file={file.name}
             onDelete={this.props.actions.deleteStruct}
@@ -161,6 +181,7 @@ class UMLDiagram extends Component {
             onAddMethod={this.props.actions.addStructMethod}
             onRemoveMethod={this.props.actions.removeStructMethod}
             searchTerm={this.state.searchTerm}
+            diffClass={(element, name) => this.diffClass(pkg.name, struct.name, element, name)}
         />
     );
   }
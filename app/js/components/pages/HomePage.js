@@ -10,6 +10,7 @@ class HomePage extends Component {
     super(props);
     this.state = {
       packageData: null,
+      diff: null,
     };
     this.setUpConnection();
   }
@@ -21,6 +22,11 @@ class HomePage extends Component {
       if (data.error) {
         console.error('WebSocket error:', data.error);
         alert(data.error);
+      } else if (data.changes) {
+        // Changes of a diff follow the model they apply to.
+        this.setState({ diff: data.changes });
+      } else if (data.revision !== undefined) {
+        this.setState({ diff: null });
       } else if (data.fileChanged || data.packages) {
         console.log('Updating package data:', data);
         this.setState({ packageData: data });
@@ -42,7 +48,7 @@ class HomePage extends Component {
     console.log('Current state:', this.state);
     console.log('Current props:', this.props);
 
-    const { packageData } = this.state;
+    const { packageData, diff } = this.state;
 
     if (!packageData || packageData.packages.length === 0) {
       console.log('Loading...');
@@ -54,6 +60,7 @@ class HomePage extends Component {
           <UMLDiagram
               actions={this.props.actions}
               data={packageData}
+              diff={diff}
           />
         </div>
     );
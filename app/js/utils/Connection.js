@@ -1,9 +1,16 @@
 let conn;
 
 class Connection {
+    // Connects to the server that served the page, with the session token
+    // the server put in the page URL. A page served elsewhere, such as by
+    // the development server, names the Go server in a server parameter.
     static setUp() {
         console.log('Initializing websockets...');
-        conn = new WebSocket(`ws://localhost:5874/ws?lastMod=143918dd9ce16851`);
+        const params = new URLSearchParams(window.location.search);
+        const token = params.get('token') || '';
+        const host = params.get('server') || window.location.host;
+        const scheme = window.location.protocol === 'https:' ? 'wss' : 'ws';
+        conn = new WebSocket(`${scheme}://${host}/ws?token=${encodeURIComponent(token)}`);
         conn.onclose = e => {
             console.log('Connection closed');
         };
@@ -19,6 +26,41 @@ class Connection {
     static sendMessage(newPackageData) {
         conn.send(JSON.stringify(newPackageData));
     }
+
+    // Asks the server for the unified diff an update would produce without
+    // writing it; confirm by sending the same data with sendMessage.
+    static previewMessage(newPackageData) {
+        conn.send(JSON.stringify({ ...newPackageData, type: 'preview' }));
+    }
+
+    // Sends edit operations, such as { op: 'addField', id: 'pkg.Struct',
+    // name, fieldType }; the server answers with one result per operation.
+    // versions maps file names to the versions the diagram was loaded with.
+    // With preview set, the server only reports the diffs it would write.
+    static edit(ops, versions, preview = false) {
+        conn.send(JSON.stringify({ type: 'edit', ops, versions, preview }));
+    }
+
+    // Reverts the last edit written by the server.
+    static undo() {
+        conn.send(JSON.stringify({ type: 'undo' }));
+    }
+
+    // Applies the last undone edit again.
+    static redo() {
+        conn.send(JSON.stringify({ type: 'redo' }));
+    }
+
+    // Asks the server for the branches and tags of the repository.
+    static requestRefs() {
+        conn.send(JSON.stringify({ type: 'refs' }));
+    }
+
+    // Switches the diagram to a read-only revision; an empty revision
+    // returns to the working tree.
+    static checkout(revision) {
+        conn.send(JSON.stringify({ type: 'checkout', revision }));
+    }
 }
 
 export default Connection;
\ No newline at end of file
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"goDiagram/gitfs"
+	"goDiagram/parse"
+)
+
+const diffUsage = `usage: go-diagram diff [-format text|json] [-C dir] OLD NEW
+
+OLD and NEW are each a directory, a .zip/.tar/.tar.gz archive, or a git
+revision (commit, tag, branch, HEAD~N) of the repository containing -C,
+diagrammed at the path -C has inside it.
+
+Exit status is 0 when the models match, 1 when they differ and 2 on error.
+`
+
+const apidiffUsage = `usage: go-diagram apidiff [-format text|json] [-C dir] OLD NEW
+
+Reports changes to the exported API between OLD and NEW, which are given as
+for diff, and classifies each as compatible or breaking.
+
+Exit status is 0 when no change is breaking, 1 when one is and 2 on error.
+`
+
+// runDiff implements the diff subcommand and returns the exit status.
+func runDiff(args []string, stdout, stderr io.Writer) int {
+	format, oldModel, newModel, ok := loadModels("diff", diffUsage, args, stderr)
+	if !ok {
+		return 2
+	}
+
+	diff := parse.DiffModels(oldModel, newModel)
+	if err := report(stdout, format, diff, diff.Changes); err != nil {
+		fmt.Fprintf(stderr, "diff: %v\n", err)
+		return 2
+	}
+	if len(diff.Changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runAPIDiff implements the apidiff subcommand and returns the exit status.
+func runAPIDiff(args []string, stdout, stderr io.Writer) int {
+	format, oldModel, newModel, ok := loadModels("apidiff", apidiffUsage, args, stderr)
+	if !ok {
+		return 2
+	}
+
+	changes := parse.APIDiff(oldModel, newModel)
+	if err := report(stdout, format, changes, changes); err != nil {
+		fmt.Fprintf(stderr, "apidiff: %v\n", err)
+		return 2
+	}
+	if parse.HasBreaking(changes) {
+		return 1
+	}
+	return 0
+}
+
+// loadModels parses the flags and the two sources shared by the diff
+// subcommands. Problems are reported on stderr.
+func loadModels(name, usage string, args []string, stderr io.Writer) (format string, oldModel, newModel *parse.ClientStruct, ok bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&format, "format", "text", "output format: text or json")
+	dir := flags.String("C", ".", "directory diagrammed for git revisions")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", nil, nil, false
+	}
+	if flags.NArg() != 2 || (format != "text" && format != "json") {
+		flags.Usage()
+		return "", nil, nil, false
+	}
+
+	ctx := context.Background()
+	var err error
+	if oldModel, err = loadSource(ctx, flags.Arg(0), *dir); err == nil {
+		newModel, err = loadSource(ctx, flags.Arg(1), *dir)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return "", nil, nil, false
+	}
+	return format, oldModel, newModel, true
+}
+
+// report writes v as indented JSON, or each of the lines on its own.
+func report[T fmt.Stringer](w io.Writer, format string, v interface{}, lines []T) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSource builds the model of spec, which is a directory, an archive, or
+// a git revision of the repository containing dir.
+func loadSource(ctx context.Context, spec, dir string) (*parse.ClientStruct, error) {
+	opts := parse.Options{CacheDir: resolveCacheDir("")}
+
+	if info, err := os.Stat(spec); err == nil {
+		if info.IsDir() {
+			model, _, err := parse.Load(ctx, spec, opts)
+			return model, err
+		}
+		if isArchive(spec) {
+			fsys, closer, err := parse.OpenArchive(spec)
+			if err != nil {
+				return nil, err
+			}
+			defer closer.Close()
+			opts.FS = fsys
+			model, _, err := parse.Load(ctx, ".", opts)
+			return model, err
+		}
+	}
+
+	repo, err := gitfs.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a directory, an archive nor a revision: %w", spec, err)
+	}
+	fsys, _, err := repo.FS(spec)
+	if err != nil {
+		return nil, err
+	}
+	root, err := repoRoot(repo, dir)
+	if err != nil {
+		return nil, err
+	}
+	opts.FS = fsys
+	model, _, err := parse.Load(ctx, root, opts)
+	return model, err
+}
+
+func isArchive(name string) bool {
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"goDiagram/parse"
+)
+
+// typeCheckTimeout bounds the type check of an edit.
+const typeCheckTimeout = time.Minute
+
+// PreviewMessage answers a "preview" request with the unified diff each
+// edited file would get. Nothing has been written; the client confirms by
+// sending the same model as a plain update.
+type PreviewMessage struct {
+	Preview     []FilePreview      `json:"preview"`
+	Diagnostics []parse.Diagnostic `json:"diagnostics"`
+}
+
+type FilePreview struct {
+	File string `json:"file"`
+	Diff string `json:"diff"`
+}
+
+// JournalMessage tells the client which files an undo or redo restored.
+// The new model follows once the watcher has picked up the change.
+type JournalMessage struct {
+	Action string   `json:"action"`
+	Files  []string `json:"files"`
+}
+
+// ModifiedMessage tells the client which files an update wrote; it is empty
+// when the model matched the sources already. Versions are the new versions
+// of the files, by their name in the model. Like all file names in the
+// protocol, names are slash-separated and relative to dirName.
+type ModifiedMessage struct {
+	Modified []string          `json:"modified"`
+	Versions map[string]string `json:"versions,omitempty"`
+}
+
+// EditRequest is the body of an "edit" request: operations applied one by
+// one, each checked and journaled as an edit of its own. Versions are the
+// versions of the files the client's model was built from, by name; the
+// request is refused if any of them changed since. A Preview request writes
+// nothing: each operation is rendered against the files on disk as if it
+// were the only one, and its result lists the files it would modify with
+// their diffs.
+type EditRequest struct {
+	Ops      []parse.Op        `json:"ops"`
+	Versions map[string]string `json:"versions"`
+	Preview  bool              `json:"preview"`
+}
+
+// EditResultMessage answers an "edit" request with one result per
+// operation, in order.
+type EditResultMessage struct {
+	Results []OpResult `json:"results"`
+}
+
+// OpResult is the outcome of one operation. ID is the entity the operation
+// left, e.g. the new ID of a renamed struct, and Modified the files it
+// wrote, with their new Versions. A failed operation has an Error and writes
+// nothing; the following ones are still applied.
+type OpResult struct {
+	Op          string             `json:"op"`
+	ID          string             `json:"id,omitempty"`
+	Modified    []string           `json:"modified"`
+	Versions    map[string]string  `json:"versions,omitempty"`
+	Preview     []FilePreview      `json:"preview,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Diagnostics []parse.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// readOnly reports whether the server refuses all edits of the working tree.
+func readOnly() bool {
+	return *readOnlyFlag || config.ReadOnly || archiveFS != nil
+}
+
+// checkWritable reports why the client may not edit the sources, if it may
+// not.
+func (c *Connection) checkWritable() error {
+	if *readOnlyFlag || config.ReadOnly {
+		return errors.New("the server is read-only; editing is disabled")
+	}
+	if archiveFS != nil {
+		return errors.New("the diagram was loaded from an archive and is read-only")
+	}
+	if rev := c.revision(); rev != "" {
+		return fmt.Errorf("revision %s is read-only; check out the working tree to edit", rev)
+	}
+	return nil
+}
+
+// preview renders the model in message against the sources and sends the
+// resulting diffs, without writing anything.
+func (c *Connection) preview(message json.RawMessage) {
+	if err := c.checkWritable(); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	var clientStruct parse.ClientStruct
+	if err := json.Unmarshal(message, &clientStruct); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	pkgsMu.RLock()
+	edits, err := parse.RenderClientPackages(pkgs, config.DirName, clientStruct.Packages)
+	var diagnostics []parse.Diagnostic
+	if err == nil {
+		diagnostics, err = checkEdits(edits)
+	}
+	pkgsMu.RUnlock()
+	if err != nil {
+		log.Printf("Error previewing update from client %s: %v", c.ws.RemoteAddr(), err)
+		c.send <- editError(err)
+		return
+	}
+
+	previews := filePreviews(edits)
+	c.send <- PreviewMessage{Preview: previews, Diagnostics: diagnostics}
+	log.Printf("Sent preview of %d file(s) to client %s", len(previews), c.ws.RemoteAddr())
+}
+
+// apply writes an updated model to the sources through the journal. The
+// edit is rejected, and nothing written, if it does not type-check.
+func (c *Connection) apply(clientStruct parse.ClientStruct) {
+	if err := c.checkWritable(); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	pkgsMu.Lock()
+	defer pkgsMu.Unlock()
+
+	edits, err := parse.RenderClientPackages(pkgs, config.DirName, clientStruct.Packages)
+	if err != nil {
+		log.Printf("Error writing client packages: %v", err)
+		c.send <- editError(err)
+		return
+	}
+	if len(edits) == 0 {
+		c.send <- ModifiedMessage{Modified: []string{}}
+		log.Printf("Update from client %s changed no files", c.ws.RemoteAddr())
+		return
+	}
+	diagnostics, err := checkEdits(edits)
+	if err != nil {
+		log.Printf("Error type-checking update from client %s: %v", c.ws.RemoteAddr(), err)
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	if len(diagnostics) > 0 {
+		log.Printf("Rejected update from client %s with %d type error(s)", c.ws.RemoteAddr(), len(diagnostics))
+		c.send <- ClientError{
+			Error:       fmt.Sprintf("the edit does not compile: %s", diagnostics[0].Message),
+			Diagnostics: diagnostics,
+		}
+		return
+	}
+	if err := journal.Apply(edits); err != nil {
+		log.Printf("Error writing client packages: %v", err)
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	files := make([]string, 0, len(edits))
+	for _, edit := range edits {
+		files = append(files, displayName(edit.Name))
+	}
+	c.send <- ModifiedMessage{Modified: files, Versions: newVersions(edits)}
+	log.Printf("Processed update from client %s: %v", c.ws.RemoteAddr(), files)
+}
+
+// editError reports a refused edit. A version conflict carries the current
+// state of the file, so that the client can redo the edit on top of it.
+func editError(err error) ClientError {
+	msg := ClientError{Error: err.Error()}
+	var conflict *parse.ConflictError
+	if errors.As(err, &conflict) && conflict.Version != "" {
+		if file, err := parse.ReadFile(config.DirName, conflict.File); err == nil {
+			file.Name = displayName(file.Name)
+			msg.Conflict = &file
+		}
+	}
+	return msg
+}
+
+// newVersions returns the versions the edits give their files.
+func newVersions(edits []parse.FileEdit) map[string]string {
+	versions := make(map[string]string, len(edits))
+	for _, edit := range edits {
+		versions[displayName(edit.Name)] = parse.FileVersion(edit.New)
+	}
+	return versions
+}
+
+// resolveVersions returns versions keyed by the paths on disk of the files
+// the client names.
+func resolveVersions(versions map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(versions))
+	for name, version := range versions {
+		path, err := parse.ResolvePath(config.DirName, name)
+		if err != nil {
+			return nil, err
+		}
+		resolved[path] = version
+	}
+	return resolved, nil
+}
+
+// edit applies the operations of an "edit" request in order.
+func (c *Connection) edit(message json.RawMessage) {
+	if err := c.checkWritable(); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	var req EditRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	versions, err := resolveVersions(req.Versions)
+	if err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	results := make([]OpResult, len(req.Ops))
+	pkgsMu.Lock()
+	if err := parse.CheckVersions(versions); err != nil {
+		pkgsMu.Unlock()
+		log.Printf("Refused operations from client %s: %v", c.ws.RemoteAddr(), err)
+		c.send <- editError(err)
+		return
+	}
+	for i, op := range req.Ops {
+		results[i] = applyOp(op, req.Preview)
+	}
+	pkgsMu.Unlock()
+	c.send <- EditResultMessage{Results: results}
+	log.Printf("Processed %d operation(s) from client %s", len(req.Ops), c.ws.RemoteAddr())
+}
+
+// applyOp renders, checks and writes a single operation, or only previews
+// it. The caller holds pkgsMu.
+func applyOp(op parse.Op, preview bool) OpResult {
+	result := OpResult{Op: op.Op, Modified: []string{}}
+	if op.File != "" {
+		file, err := parse.ResolvePath(config.DirName, op.File)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		op.File = file
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), typeCheckTimeout)
+	edits, id, err := parse.RenderOp(ctx, pkgs, op)
+	cancel()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	diagnostics, err := checkEdits(edits)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(diagnostics) > 0 {
+		result.Error = fmt.Sprintf("the edit does not compile: %s", diagnostics[0].Message)
+		result.Diagnostics = diagnostics
+		return result
+	}
+	result.ID = id
+	for _, edit := range edits {
+		result.Modified = append(result.Modified, displayName(edit.Name))
+	}
+	if preview {
+		result.Preview = filePreviews(edits)
+		return result
+	}
+	if len(edits) > 0 {
+		if err := journal.Apply(edits); err != nil {
+			return OpResult{Op: op.Op, Modified: []string{}, Error: err.Error()}
+		}
+		result.Versions = newVersions(edits)
+	}
+	return result
+}
+
+// filePreviews returns the unified diff of each edit; a created file is
+// diffed against /dev/null.
+func filePreviews(edits []parse.FileEdit) []FilePreview {
+	previews := []FilePreview{}
+	for _, edit := range edits {
+		name := displayName(edit.Name)
+		from := "a/" + name
+		if edit.Old == nil {
+			from = "/dev/null"
+		}
+		previews = append(previews, FilePreview{File: name, Diff: parse.UnifiedDiff(from, "b/"+name, edit.Old, edit.New)})
+	}
+	return previews
+}
+
+// checkEdits type-checks the edits, along with the packages of the diagram
+// that may depend on them, and returns the errors they would introduce, with
+// file names as the client knows them. The caller holds pkgsMu.
+func checkEdits(edits []parse.FileEdit) ([]parse.Diagnostic, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), typeCheckTimeout)
+	defer cancel()
+	diagnostics, err := parse.CheckEdits(ctx, pkgs, edits)
+	if err != nil {
+		return nil, err
+	}
+	for i := range diagnostics {
+		if diagnostics[i].File != "" {
+			diagnostics[i].File = displayName(diagnostics[i].File)
+		}
+	}
+	return diagnostics, nil
+}
+
+// displayName returns name relative to dirName when it lies inside it.
+func displayName(name string) string {
+	dir, err := filepath.Abs(config.DirName)
+	if err != nil {
+		return filepath.ToSlash(name)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return filepath.ToSlash(name)
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || strings.HasPrefix(filepath.ToSlash(rel), "..") {
+		return filepath.ToSlash(name)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// undo reverts the last edit applied through the server, or redoes the last
+// undone one. Either is refused if a file it touches changed on disk since.
+func (c *Connection) undo(action string) {
+	if err := c.checkWritable(); err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	var edits []parse.FileEdit
+	var err error
+	pkgsMu.Lock()
+	if action == "undo" {
+		edits, err = journal.Undo()
+	} else {
+		edits, err = journal.Redo()
+	}
+	pkgsMu.Unlock()
+	if err != nil {
+		log.Printf("Error processing %s from client %s: %v", action, c.ws.RemoteAddr(), err)
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+
+	files := make([]string, 0, len(edits))
+	for _, edit := range edits {
+		files = append(files, displayName(edit.Name))
+	}
+	c.send <- JournalMessage{Action: action, Files: files}
+	log.Printf("Processed %s from client %s: %v", action, c.ws.RemoteAddr(), files)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"goDiagram/parse"
+)
+
+func TestEditErrorConflict(t *testing.T) {
+	dir := t.TempDir()
+	src := []byte("package sub\n\ntype S struct{ N int }\n")
+	name := filepath.Join(dir, "sub", "a.go")
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = Config{DirName: dir}
+
+	// A stale version comes back with the current state of the file.
+	msg := editError(parse.CheckVersions(map[string]string{name: "0123456789abcdef"}))
+	if msg.Conflict == nil {
+		t.Fatalf("stale version: no conflict in %+v", msg)
+	}
+	file := msg.Conflict
+	if file.Name != "sub/a.go" || file.Version != parse.FileVersion(src) || len(file.Structs) != 1 || file.Structs[0].ID != "sub.S" {
+		t.Errorf("stale version: conflict %+v", file)
+	}
+
+	// A removed file has no state to send.
+	msg = editError(parse.CheckVersions(map[string]string{filepath.Join(dir, "gone.go"): "0123456789abcdef"}))
+	if msg.Conflict != nil || !strings.Contains(msg.Error, "removed") {
+		t.Errorf("removed file: %+v", msg)
+	}
+}
@@ -0,0 +1,233 @@
+package gitfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// treeEntry is one line of a tree object.
+type treeEntry struct {
+	name string
+	mode string
+	hash Hash
+}
+
+func (e treeEntry) isDir() bool {
+	return e.mode == "40000"
+}
+
+// isFile reports whether the entry is a regular file. Symlinks and
+// submodules are left out of the file system.
+func (e treeEntry) isFile() bool {
+	return e.mode == "100644" || e.mode == "100755"
+}
+
+// FS returns the tree of the commit rev resolves to as a read-only fs.FS,
+// together with the hash of that commit.
+func (r *Repo) FS(rev string) (fs.FS, Hash, error) {
+	commit, err := r.Resolve(rev)
+	if err != nil {
+		return nil, Hash{}, err
+	}
+	_, data, err := r.readObject(commit)
+	if err != nil {
+		return nil, Hash{}, err
+	}
+	tree, err := header(data, "tree")
+	if err != nil {
+		return nil, Hash{}, fmt.Errorf("commit %s: %w", commit, err)
+	}
+	root, err := ParseHash(tree)
+	if err != nil {
+		return nil, Hash{}, fmt.Errorf("commit %s: %w", commit, err)
+	}
+	return &treeFS{repo: r, root: root, trees: map[Hash][]treeEntry{}}, commit, nil
+}
+
+// treeFS serves the files of a tree object.
+type treeFS struct {
+	repo *Repo
+	root Hash
+
+	mu    sync.Mutex
+	trees map[Hash][]treeEntry
+}
+
+func (t *treeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry := treeEntry{name: ".", mode: "40000", hash: t.root}
+	if name != "." {
+		for _, elem := range strings.Split(name, "/") {
+			if !entry.isDir() {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			entries, err := t.tree(entry.hash)
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			found := false
+			for _, e := range entries {
+				if e.name == elem {
+					entry, found = e, true
+					break
+				}
+			}
+			if !found {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+		}
+	}
+
+	if entry.isDir() {
+		entries, err := t.tree(entry.hash)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &treeDir{fs: t, info: entryInfo{entry: entry}, entries: entries}, nil
+	}
+
+	typ, data, err := t.repo.readObject(entry.hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if typ != objBlob {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("object %s is a %s, not a blob", entry.hash, typ)}
+	}
+	return &blobFile{info: entryInfo{entry: entry, size: int64(len(data))}, Reader: bytes.NewReader(data)}, nil
+}
+
+// tree returns the regular files and directories of a tree object.
+func (t *treeFS) tree(h Hash) ([]treeEntry, error) {
+	t.mu.Lock()
+	entries, ok := t.trees[h]
+	t.mu.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	typ, data, err := t.repo.readObject(h)
+	if err != nil {
+		return nil, err
+	}
+	if typ != objTree {
+		return nil, fmt.Errorf("object %s is a %s, not a tree", h, typ)
+	}
+
+	entries = []treeEntry{}
+	for len(data) > 0 {
+		hdr, rest, ok := bytes.Cut(data, []byte{0})
+		if !ok || len(rest) < 20 {
+			return nil, fmt.Errorf("tree %s: malformed entry", h)
+		}
+		mode, name, ok := strings.Cut(string(hdr), " ")
+		if !ok {
+			return nil, fmt.Errorf("tree %s: malformed entry", h)
+		}
+		entry := treeEntry{name: name, mode: mode}
+		copy(entry.hash[:], rest[:20])
+		data = rest[20:]
+		if entry.isDir() || entry.isFile() {
+			entries = append(entries, entry)
+		}
+	}
+
+	t.mu.Lock()
+	t.trees[h] = entries
+	t.mu.Unlock()
+	return entries, nil
+}
+
+// entryInfo describes a tree entry.
+type entryInfo struct {
+	entry treeEntry
+	size  int64
+}
+
+func (i entryInfo) Name() string       { return i.entry.name }
+func (i entryInfo) Size() int64        { return i.size }
+func (i entryInfo) ModTime() time.Time { return time.Time{} }
+func (i entryInfo) IsDir() bool        { return i.entry.isDir() }
+func (i entryInfo) Sys() interface{}   { return nil }
+
+func (i entryInfo) Mode() fs.FileMode {
+	switch i.entry.mode {
+	case "40000":
+		return fs.ModeDir | 0555
+	case "100755":
+		return 0555
+	}
+	return 0444
+}
+
+type blobFile struct {
+	info entryInfo
+	*bytes.Reader
+}
+
+func (f *blobFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *blobFile) Close() error               { return nil }
+
+type treeDir struct {
+	fs      *treeFS
+	info    entryInfo
+	entries []treeEntry
+	offset  int
+}
+
+func (d *treeDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *treeDir) Close() error               { return nil }
+
+func (d *treeDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *treeDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	d.offset += len(rest)
+
+	list := make([]fs.DirEntry, 0, len(rest))
+	for _, entry := range rest {
+		list = append(list, treeDirEntry{fs: d.fs, entry: entry})
+	}
+	return list, nil
+}
+
+// treeDirEntry reads the blob only when Info is asked for its size.
+type treeDirEntry struct {
+	fs    *treeFS
+	entry treeEntry
+}
+
+func (e treeDirEntry) Name() string      { return e.entry.name }
+func (e treeDirEntry) IsDir() bool       { return e.entry.isDir() }
+func (e treeDirEntry) Type() fs.FileMode { return entryInfo{entry: e.entry}.Mode().Type() }
+
+func (e treeDirEntry) Info() (fs.FileInfo, error) {
+	info := entryInfo{entry: e.entry}
+	if e.entry.isDir() {
+		return info, nil
+	}
+	_, data, err := e.fs.repo.readObject(e.entry.hash)
+	if err != nil {
+		return nil, err
+	}
+	info.size = int64(len(data))
+	return info, nil
+}
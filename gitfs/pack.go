@@ -0,0 +1,289 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pack object types, as stored in the pack entry header.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+// maxCachedBases bounds the number of delta bases kept in memory per pack.
+const maxCachedBases = 256
+
+// pack is a packfile together with its version 2 index.
+type pack struct {
+	packFile string
+	hashes   []Hash
+	offsets  []uint64
+
+	mu    sync.Mutex
+	bases map[uint64]packObject
+}
+
+type packObject struct {
+	typ  objectType
+	data []byte
+}
+
+func openPack(idxFile string) (*pack, error) {
+	idx, err := os.ReadFile(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index version", idxFile)
+	}
+
+	fanout := idx[8 : 8+256*4]
+	n := int(binary.BigEndian.Uint32(fanout[255*4:]))
+	hashesStart := 8 + 256*4
+	offsetsStart := hashesStart + n*20 + n*4
+	largeStart := offsetsStart + n*4
+	if len(idx) < largeStart {
+		return nil, fmt.Errorf("%s: truncated pack index", idxFile)
+	}
+
+	p := &pack{
+		packFile: strings.TrimSuffix(idxFile, ".idx") + ".pack",
+		hashes:   make([]Hash, n),
+		offsets:  make([]uint64, n),
+		bases:    map[uint64]packObject{},
+	}
+	for i := 0; i < n; i++ {
+		copy(p.hashes[i][:], idx[hashesStart+i*20:])
+		offset := binary.BigEndian.Uint32(idx[offsetsStart+i*4:])
+		if offset&0x80000000 == 0 {
+			p.offsets[i] = uint64(offset)
+			continue
+		}
+		large := largeStart + int(offset&0x7fffffff)*8
+		if len(idx) < large+8 {
+			return nil, fmt.Errorf("%s: truncated pack index", idxFile)
+		}
+		p.offsets[i] = binary.BigEndian.Uint64(idx[large:])
+	}
+	return p, nil
+}
+
+func (p *pack) find(h Hash) (uint64, bool) {
+	i := sort.Search(len(p.hashes), func(i int) bool {
+		return bytes.Compare(p.hashes[i][:], h[:]) >= 0
+	})
+	if i < len(p.hashes) && p.hashes[i] == h {
+		return p.offsets[i], true
+	}
+	return 0, false
+}
+
+func (p *pack) withPrefix(prefix string) []Hash {
+	var matches []Hash
+	i := sort.Search(len(p.hashes), func(i int) bool {
+		return p.hashes[i].String() >= prefix
+	})
+	for ; i < len(p.hashes) && strings.HasPrefix(p.hashes[i].String(), prefix); i++ {
+		matches = append(matches, p.hashes[i])
+	}
+	return matches
+}
+
+// readAt reads the object stored at offset, applying deltas. Bases of
+// REF_DELTA entries may live elsewhere, so they are looked up through r.
+func (p *pack) readAt(r *Repo, offset uint64) (objectType, []byte, error) {
+	p.mu.Lock()
+	cached, ok := p.bases[offset]
+	p.mu.Unlock()
+	if ok {
+		return cached.typ, cached.data, nil
+	}
+
+	f, err := os.Open(p.packFile)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(io.NewSectionReader(f, int64(offset), 1<<62))
+	c, err := br.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	kind := (c >> 4) & 7
+	for c&0x80 != 0 {
+		// The inflated size is implied by the zlib stream; skip it.
+		if c, err = br.ReadByte(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var typ objectType
+	var data []byte
+	switch kind {
+	case packCommit, packTree, packBlob, packTag:
+		typ = [...]objectType{packCommit: objCommit, packTree: objTree, packBlob: objBlob, packTag: objTag}[kind]
+		data, err = inflate(br)
+	case packOfsDelta:
+		var rel uint64
+		rel, err = readOffset(br)
+		if err != nil {
+			break
+		}
+		if rel > offset {
+			err = errors.New("delta base before start of pack")
+			break
+		}
+		var delta, base []byte
+		if delta, err = inflate(br); err != nil {
+			break
+		}
+		if typ, base, err = p.readAt(r, offset-rel); err != nil {
+			break
+		}
+		data, err = applyDelta(base, delta)
+	case packRefDelta:
+		var baseHash Hash
+		if _, err = io.ReadFull(br, baseHash[:]); err != nil {
+			break
+		}
+		var delta, base []byte
+		if delta, err = inflate(br); err != nil {
+			break
+		}
+		if typ, base, err = r.readObject(baseHash); err != nil {
+			break
+		}
+		data, err = applyDelta(base, delta)
+	default:
+		err = fmt.Errorf("unknown pack object type %d", kind)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%s at offset %d: %w", p.packFile, offset, err)
+	}
+
+	p.mu.Lock()
+	if len(p.bases) >= maxCachedBases {
+		p.bases = map[uint64]packObject{}
+	}
+	p.bases[offset] = packObject{typ: typ, data: data}
+	p.mu.Unlock()
+
+	return typ, data, nil
+}
+
+// readOffset decodes the base offset of an OFS_DELTA entry.
+func readOffset(br *bufio.Reader) (uint64, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := uint64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | uint64(c&0x7f)
+	}
+	return offset, nil
+}
+
+func inflate(r io.Reader) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// applyDelta rebuilds an object from its base and a git delta.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	dstSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var offset, size uint64
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errors.New("truncated delta")
+					}
+					offset |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errors.New("truncated delta")
+					}
+					size |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errors.New("delta copy out of range")
+			}
+			out = append(out, base[offset:offset+size]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, errors.New("truncated delta")
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errors.New("invalid delta opcode")
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return out, nil
+}
+
+func deltaSize(delta []byte) (uint64, []byte, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(delta) == 0 {
+			return 0, nil, errors.New("truncated delta header")
+		}
+		c := delta[0]
+		delta = delta[1:]
+		size |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return size, delta, nil
+		}
+	}
+}
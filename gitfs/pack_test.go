@@ -0,0 +1,123 @@
+package gitfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// delta builds a git delta from the base and result sizes and the
+// instructions.
+func delta(srcSize, dstSize int, ops ...byte) []byte {
+	var d []byte
+	for _, size := range []int{srcSize, dstSize} {
+		for size >= 0x80 {
+			d = append(d, byte(size)|0x80)
+			size >>= 7
+		}
+		d = append(d, byte(size))
+	}
+	return append(d, ops...)
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world")
+	big := make([]byte, 0x10000+10)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	tests := []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  string
+		err   bool
+	}{
+		// Copy "world" (offset 7, size 5), then insert "!".
+		{name: "copy and insert", base: base, delta: delta(12, 6, 0x91, 7, 5, 1, '!'), want: "world!"},
+		{name: "insert only", base: base, delta: delta(12, 3, 3, 'a', 'b', 'c'), want: "abc"},
+		// Offset and size bytes may be left out when zero.
+		{name: "copy from start", base: base, delta: delta(12, 5, 0x90, 5), want: "hello"},
+		{name: "base size mismatch", base: base, delta: delta(11, 3, 3, 'a', 'b', 'c'), err: true},
+		{name: "result size mismatch", base: base, delta: delta(12, 4, 3, 'a', 'b', 'c'), err: true},
+		{name: "copy out of range", base: base, delta: delta(12, 5, 0x91, 10, 5), err: true},
+		{name: "truncated insert", base: base, delta: delta(12, 3, 3, 'a'), err: true},
+		{name: "truncated copy", base: base, delta: delta(12, 3, 0x91, 7), err: true},
+		{name: "reserved opcode", base: base, delta: delta(12, 0, 0), err: true},
+		{name: "truncated header", base: base, delta: []byte{0x8c}, err: true},
+	}
+	for _, test := range tests {
+		got, err := applyDelta(test.base, test.delta)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: got %q, want an error", test.name, got)
+		case !test.err && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !test.err && string(got) != test.want:
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// A copy with no size bytes copies 0x10000 bytes.
+	got, err := applyDelta(big, delta(len(big), 0x10000, 0x81, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0x10000 || got[0] != 10 {
+		t.Errorf("copy of 0x10000 bytes: got %d bytes starting with %d", len(got), got[0])
+	}
+}
+
+// TestLargeOffsets reads an index whose second object lies past 2 GiB, so
+// that its offset is in the table of 64-bit offsets.
+func TestLargeOffsets(t *testing.T) {
+	hashes := []Hash{{0x01}, {0xfe}}
+	offsets := []uint64{12, 5 << 30}
+
+	idx := []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}
+	for i := 0; i < 256; i++ {
+		n := 0
+		for _, h := range hashes {
+			if int(h[0]) <= i {
+				n++
+			}
+		}
+		idx = binary.BigEndian.AppendUint32(idx, uint32(n))
+	}
+	for _, h := range hashes {
+		idx = append(idx, h[:]...)
+	}
+	idx = append(idx, make([]byte, 4*len(hashes))...) // CRCs
+	idx = binary.BigEndian.AppendUint32(idx, uint32(offsets[0]))
+	idx = binary.BigEndian.AppendUint32(idx, 0x80000000)
+	idx = binary.BigEndian.AppendUint64(idx, offsets[1])
+
+	name := filepath.Join(t.TempDir(), "pack-test.idx")
+	if err := os.WriteFile(name, idx, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := openPack(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hashes {
+		if offset, ok := p.find(h); !ok || offset != offsets[i] {
+			t.Errorf("find(%s) = %d, %v, want %d", h, offset, ok, offsets[i])
+		}
+	}
+	if _, ok := p.find(Hash{0x02}); ok {
+		t.Error("found a hash that is not in the index")
+	}
+	if got := p.withPrefix("fe"); len(got) != 1 || got[0] != hashes[1] {
+		t.Errorf("withPrefix(fe) = %v", got)
+	}
+
+	// An index whose large offset table is cut short is refused.
+	if err := os.WriteFile(name, idx[:len(idx)-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openPack(name); err == nil {
+		t.Error("opened a truncated index")
+	}
+}
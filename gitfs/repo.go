@@ -0,0 +1,488 @@
+// Package gitfs reads commits of a local git repository directly from its
+// object database and exposes their trees as an fs.FS, without touching the
+// working tree or running git.
+package gitfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Hash is the SHA-1 name of a git object.
+type Hash [20]byte
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// ParseHash parses a full 40 character hexadecimal object name.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	return h, nil
+}
+
+// Ref is a named pointer to a commit, such as a branch or a tag.
+type Ref struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// Repo is a git repository opened for reading.
+type Repo struct {
+	gitDir   string
+	workTree string
+
+	mu    sync.Mutex
+	packs []*pack
+}
+
+// Open opens the repository containing dir. dir may be the working tree,
+// any directory inside it, or a bare repository.
+func Open(dir string) (*Repo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if gitDir, ok := findGitDir(dir); ok {
+			r := &Repo{gitDir: gitDir}
+			if gitDir != dir {
+				r.workTree = dir
+			}
+			return r, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, errors.New("not a git repository")
+		}
+		dir = parent
+	}
+}
+
+// findGitDir reports the git directory of dir, following the "gitdir:"
+// file used by worktrees and submodules.
+func findGitDir(dir string) (string, bool) {
+	dotGit := filepath.Join(dir, ".git")
+	info, err := os.Stat(dotGit)
+	switch {
+	case err == nil && info.IsDir():
+		return dotGit, true
+	case err == nil:
+		data, err := os.ReadFile(dotGit)
+		if err != nil {
+			return "", false
+		}
+		line := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(line, "gitdir:") {
+			return "", false
+		}
+		gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(dir, gitDir)
+		}
+		return gitDir, true
+	}
+
+	// A bare repository.
+	if isDir(filepath.Join(dir, "objects")) && isDir(filepath.Join(dir, "refs")) {
+		if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// WorkTree returns the top directory of the working tree, or "" for a bare
+// repository. Paths in the file systems returned by FS are relative to it.
+func (r *Repo) WorkTree() string {
+	return r.workTree
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// commonDir is where objects and shared refs live. For a linked worktree it
+// differs from the worktree's own git directory.
+func (r *Repo) commonDir() string {
+	data, err := os.ReadFile(filepath.Join(r.gitDir, "commondir"))
+	if err != nil {
+		return r.gitDir
+	}
+	dir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(r.gitDir, dir)
+	}
+	return dir
+}
+
+// Refs lists HEAD, the branches, remote branches and tags, sorted by name.
+func (r *Repo) Refs() ([]Ref, error) {
+	refs, err := r.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []Ref
+	if head, err := r.Resolve("HEAD"); err == nil {
+		list = append(list, Ref{Name: "HEAD", Hash: head.String()})
+	}
+	for _, name := range names {
+		list = append(list, Ref{Name: name, Hash: refs[name].String()})
+	}
+	return list, nil
+}
+
+// readRefs collects the packed and loose refs; loose refs win.
+func (r *Repo) readRefs() (map[string]Hash, error) {
+	refs, err := r.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	common := r.commonDir()
+	refsDir := filepath.Join(common, "refs")
+	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(common, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if h, err := r.resolveRef(name, 0); err == nil {
+			refs[name] = h
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// resolveRef follows a ref, including symbolic refs such as HEAD.
+func (r *Repo) resolveRef(name string, depth int) (Hash, error) {
+	if depth > 10 {
+		return Hash{}, fmt.Errorf("ref %s: too many levels of symbolic refs", name)
+	}
+
+	dir := r.commonDir()
+	if name == "HEAD" {
+		dir = r.gitDir
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err == nil {
+		line := strings.TrimSpace(string(data))
+		if target, ok := strings.CutPrefix(line, "ref:"); ok {
+			return r.resolveRef(strings.TrimSpace(target), depth+1)
+		}
+		return ParseHash(line)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Hash{}, err
+	}
+
+	refs, err := r.packedRefs()
+	if err != nil {
+		return Hash{}, err
+	}
+	if h, ok := refs[name]; ok {
+		return h, nil
+	}
+	return Hash{}, fmt.Errorf("unknown ref %s", name)
+}
+
+func (r *Repo) packedRefs() (map[string]Hash, error) {
+	refs := map[string]Hash{}
+	data, err := os.ReadFile(filepath.Join(r.commonDir(), "packed-refs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		hash, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		if h, err := ParseHash(hash); err == nil {
+			refs[name] = h
+		}
+	}
+	return refs, nil
+}
+
+// Resolve turns a revision into the hash of a commit. It accepts HEAD, full
+// ref names, branch, tag and remote names, and full or abbreviated object
+// names, optionally followed by ~N and ^ ancestry suffixes. Annotated tags
+// are peeled to the commit they point to.
+func (r *Repo) Resolve(rev string) (Hash, error) {
+	name, suffix := rev, ""
+	if i := strings.IndexAny(rev, "~^"); i >= 0 {
+		name, suffix = rev[:i], rev[i:]
+	}
+
+	h, err := r.resolveName(name)
+	if err != nil {
+		return Hash{}, err
+	}
+	if h, err = r.peel(h); err != nil {
+		return Hash{}, err
+	}
+
+	for suffix != "" {
+		op := suffix[0]
+		suffix = suffix[1:]
+		digits := len(suffix) - len(strings.TrimLeft(suffix, "0123456789"))
+		n := 1
+		if digits > 0 {
+			n, _ = strconv.Atoi(suffix[:digits])
+			suffix = suffix[digits:]
+		}
+		if op == '^' {
+			// Only the first parent is supported: ^ and ^1.
+			if n > 1 {
+				return Hash{}, fmt.Errorf("unsupported revision %s", rev)
+			}
+			n = min(n, 1)
+		}
+		for ; n > 0; n-- {
+			if h, err = r.parent(h); err != nil {
+				return Hash{}, fmt.Errorf("revision %s: %w", rev, err)
+			}
+		}
+	}
+	return h, nil
+}
+
+// parent returns the first parent of a commit.
+func (r *Repo) parent(commit Hash) (Hash, error) {
+	_, data, err := r.readObject(commit)
+	if err != nil {
+		return Hash{}, err
+	}
+	parent, err := header(data, "parent")
+	if err != nil {
+		return Hash{}, fmt.Errorf("commit %s has no parent", commit)
+	}
+	return ParseHash(parent)
+}
+
+func (r *Repo) resolveName(rev string) (Hash, error) {
+	if rev == "" {
+		return Hash{}, errors.New("empty revision")
+	}
+	for _, name := range []string{rev, "refs/" + rev, "refs/tags/" + rev, "refs/heads/" + rev, "refs/remotes/" + rev} {
+		if strings.Contains(name, "..") {
+			continue
+		}
+		if h, err := r.resolveRef(name, 0); err == nil {
+			return h, nil
+		}
+	}
+	if h, err := ParseHash(rev); err == nil {
+		return h, nil
+	}
+	if len(rev) >= 4 && isHex(rev) {
+		return r.expandShort(strings.ToLower(rev))
+	}
+	return Hash{}, fmt.Errorf("unknown revision %s", rev)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandShort finds the single object whose name starts with prefix.
+func (r *Repo) expandShort(prefix string) (Hash, error) {
+	matches := map[Hash]bool{}
+
+	dir := filepath.Join(r.commonDir(), "objects", prefix[:2])
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			name := prefix[:2] + entry.Name()
+			if strings.HasPrefix(name, prefix) {
+				if h, err := ParseHash(name); err == nil {
+					matches[h] = true
+				}
+			}
+		}
+	}
+
+	packs, err := r.loadPacks()
+	if err != nil {
+		return Hash{}, err
+	}
+	for _, p := range packs {
+		for _, h := range p.withPrefix(prefix) {
+			matches[h] = true
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return Hash{}, fmt.Errorf("unknown revision %s", prefix)
+	case 1:
+		for h := range matches {
+			return h, nil
+		}
+	}
+	return Hash{}, fmt.Errorf("ambiguous revision %s", prefix)
+}
+
+// peel follows annotated tags until it reaches a commit.
+func (r *Repo) peel(h Hash) (Hash, error) {
+	for i := 0; i < 10; i++ {
+		typ, data, err := r.readObject(h)
+		if err != nil {
+			return Hash{}, err
+		}
+		switch typ {
+		case objCommit:
+			return h, nil
+		case objTag:
+			target, err := header(data, "object")
+			if err != nil {
+				return Hash{}, err
+			}
+			if h, err = ParseHash(target); err != nil {
+				return Hash{}, err
+			}
+		default:
+			return Hash{}, fmt.Errorf("object %s is a %s, not a commit", h, typ)
+		}
+	}
+	return Hash{}, fmt.Errorf("object %s: too many levels of tags", h)
+}
+
+// header returns the value of the first header line named key in a commit
+// or tag object.
+func header(data []byte, key string) (string, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, key+" "); ok {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("missing %s header", key)
+}
+
+type objectType string
+
+const (
+	objCommit objectType = "commit"
+	objTree   objectType = "tree"
+	objBlob   objectType = "blob"
+	objTag    objectType = "tag"
+)
+
+// readObject returns the type and content of an object, loose or packed.
+func (r *Repo) readObject(h Hash) (objectType, []byte, error) {
+	typ, data, err := r.readLoose(h)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return typ, data, err
+	}
+
+	packs, err := r.loadPacks()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, p := range packs {
+		if offset, ok := p.find(h); ok {
+			return p.readAt(r, offset)
+		}
+	}
+	return "", nil, fmt.Errorf("object %s not found", h)
+}
+
+func (r *Repo) readLoose(h Hash) (objectType, []byte, error) {
+	name := h.String()
+	f, err := os.Open(filepath.Join(r.commonDir(), "objects", name[:2], name[2:]))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("object %s: %w", name, err)
+	}
+	defer zr.Close()
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, fmt.Errorf("object %s: %w", name, err)
+	}
+
+	hdr, data, ok := bytes.Cut(raw, []byte{0})
+	if !ok {
+		return "", nil, fmt.Errorf("object %s: malformed header", name)
+	}
+	typ, size, ok := strings.Cut(string(hdr), " ")
+	if !ok {
+		return "", nil, fmt.Errorf("object %s: malformed header", name)
+	}
+	if n, err := strconv.Atoi(size); err != nil || n != len(data) {
+		return "", nil, fmt.Errorf("object %s: size mismatch", name)
+	}
+	return objectType(typ), data, nil
+}
+
+// loadPacks opens the pack indexes once.
+func (r *Repo) loadPacks() ([]*pack, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.packs != nil {
+		return r.packs, nil
+	}
+	idxFiles, err := filepath.Glob(filepath.Join(r.commonDir(), "objects", "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	packs := []*pack{}
+	for _, idxFile := range idxFiles {
+		p, err := openPack(idxFile)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	r.packs = packs
+	return packs, nil
+}
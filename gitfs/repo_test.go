@@ -0,0 +1,189 @@
+package gitfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// git runs git in dir and returns its output.
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return string(out)
+}
+
+// testRepo creates a repository with a few commits on main, a side branch,
+// an annotated tag v1 and a lightweight tag v2. Files change a little from
+// one commit to the next, so that packing stores them as deltas.
+func testRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	git(t, dir, "init", "-q", "-b", "main")
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("// line %d of a file long enough to be deltified", i))
+	}
+	write := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		lines[i*30] = fmt.Sprintf("// changed in commit %d", i)
+		write("a.go", "package a\n\n"+strings.Join(lines, "\n")+"\n")
+		write("sub/b.go", fmt.Sprintf("package sub\n\nconst N = %d\n", i))
+		if i == 2 {
+			write("sub/deep/c.go", "package deep\n")
+		}
+		git(t, dir, "add", "-A")
+		git(t, dir, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+		if i == 1 {
+			git(t, dir, "tag", "-a", "v1", "-m", "version 1")
+		}
+		if i == 3 {
+			git(t, dir, "tag", "v2")
+			git(t, dir, "branch", "side")
+		}
+	}
+	return dir
+}
+
+// checkRepo compares Resolve and FS with what git reports for revs.
+func checkRepo(t *testing.T, dir string, revs []string) {
+	t.Helper()
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range revs {
+		want := strings.TrimSpace(git(t, dir, "rev-parse", rev+"^{commit}"))
+		fsys, h, err := r.FS(rev)
+		if err != nil {
+			t.Errorf("FS(%s): %v", rev, err)
+			continue
+		}
+		if h.String() != want {
+			t.Errorf("FS(%s) resolved to %s, want %s", rev, h, want)
+		}
+
+		var files []string
+		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("walking %s: %v", rev, err)
+			continue
+		}
+		wantFiles := strings.Fields(git(t, dir, "ls-tree", "-r", "--name-only", rev))
+		sort.Strings(wantFiles)
+		if strings.Join(files, " ") != strings.Join(wantFiles, " ") {
+			t.Errorf("files of %s: got %v, want %v", rev, files, wantFiles)
+			continue
+		}
+		for _, name := range files {
+			got, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				t.Errorf("reading %s at %s: %v", name, rev, err)
+				continue
+			}
+			if want := git(t, dir, "show", rev+":"+name); string(got) != want {
+				t.Errorf("content of %s at %s differs from git show", name, rev)
+			}
+		}
+	}
+}
+
+func testRevs(t *testing.T, dir string) []string {
+	head := strings.TrimSpace(git(t, dir, "rev-parse", "HEAD~1"))
+	return []string{"HEAD", "HEAD~1", "HEAD~3", "HEAD^", "HEAD^^", "main", "side", "v1", "v2", "refs/tags/v1", head, head[:7]}
+}
+
+func TestLooseObjects(t *testing.T) {
+	dir := testRepo(t)
+	checkRepo(t, dir, testRevs(t, dir))
+}
+
+func TestPackedObjects(t *testing.T) {
+	dir := testRepo(t)
+	git(t, dir, "repack", "-adq")
+	git(t, dir, "pack-refs", "--all")
+	if _, err := os.Stat(filepath.Join(dir, ".git", "refs", "heads", "main")); err == nil {
+		t.Fatal("refs were not packed")
+	}
+	checkRepo(t, dir, testRevs(t, dir))
+}
+
+// TestRefDeltas packs without offset deltas, so that deltas name their base
+// by hash.
+func TestRefDeltas(t *testing.T) {
+	dir := testRepo(t)
+	git(t, dir, "-c", "repack.useDeltaBaseOffset=false", "repack", "-adfq")
+	checkRepo(t, dir, testRevs(t, dir))
+}
+
+func TestRefs(t *testing.T) {
+	dir := testRepo(t)
+	git(t, dir, "pack-refs", "--all")
+	r, err := Open(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.WorkTree() != dir {
+		t.Errorf("WorkTree() = %s, want %s", r.WorkTree(), dir)
+	}
+	refs, err := r.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ref := range refs {
+		got = append(got, ref.Name+" "+ref.Hash)
+	}
+	want := []string{"HEAD " + strings.TrimSpace(git(t, dir, "rev-parse", "HEAD"))}
+	for _, line := range strings.Split(strings.TrimSpace(git(t, dir, "for-each-ref", "--format=%(refname) %(objectname)")), "\n") {
+		want = append(want, line)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Refs() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	dir := testRepo(t)
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range []string{"", "nope", "HEAD~10", "HEAD^2", "zzzz", "../HEAD"} {
+		if h, err := r.Resolve(rev); err == nil {
+			t.Errorf("Resolve(%q) = %s, want an error", rev, h)
+		}
+	}
+}
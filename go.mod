@@ -5,7 +5,11 @@ go 1.23.1
 require (
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gorilla/websocket v1.5.3
-	golang.org/x/tools v0.25.0
+	golang.org/x/tools v0.30.0
 )
 
-require golang.org/x/sys v0.25.0 // indirect
+require (
+	golang.org/x/mod v0.23.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,169 @@
+package parse
+
+import (
+	"go/token"
+	"strings"
+)
+
+// Compatibility says whether an API change can break code that imports the
+// package.
+type Compatibility string
+
+const (
+	Compatible Compatibility = "compatible"
+	Breaking   Compatibility = "breaking"
+)
+
+// APIChange is a change to the exported API of a package, classified under
+// the Go 1 compatibility rules.
+type APIChange struct {
+	Change
+	Compatibility Compatibility `json:"compatibility"`
+	Reason        string        `json:"reason"`
+}
+
+// String formats the change as one line of the report, prefixed by its
+// classification.
+func (c APIChange) String() string {
+	return string(c.Compatibility) + ": " + c.Change.String() + " (" + c.Reason + ")"
+}
+
+// APIDiff reports the changes to exported structs, interfaces, fields,
+// methods and functions between two models. Unexported identifiers, main
+// packages and external test packages are not part of an API and are left
+// out, except for unexported interface methods, which decide who can
+// implement an interface.
+//
+// Removing anything, or changing the type of a field or the signature of a
+// method or function, is breaking; renaming parameters is not. Embedded
+// fields count as fields named after their type. A method whose receiver
+// becomes a pointer leaves the method set of values, which breaks; the
+// reverse only adds to it. Adding is compatible,
+// except that a new method or embedded interface breaks every
+// implementation outside the package, unless the interface already had an
+// unexported method and so could not be implemented outside anyway.
+func APIDiff(oldModel, newModel *ClientStruct) []APIChange {
+	oldSigs, oldPointers := apiSignatures(oldModel)
+	newSigs, newPointers := apiSignatures(newModel)
+	oldIfaces := indexInterfaces(oldModel)
+
+	changes := []APIChange{}
+	for _, change := range DiffModels(oldModel, newModel).Changes {
+		if !isAPI(change) {
+			continue
+		}
+		c := APIChange{Change: change, Compatibility: Breaking}
+		switch change.Kind {
+		case Removed:
+			c.Reason = "removed"
+		case Changed:
+			key := strings.Join([]string{change.Package, change.Type, change.Name}, "\x00")
+			switch {
+			case change.Element == ElementField:
+				c.Reason = "field type changed"
+			case oldSigs[key] != newSigs[key]:
+				c.Reason = "signature changed"
+			case !oldPointers[key] && newPointers[key]:
+				c.Reason = "receiver changed from value to pointer"
+			case oldPointers[key] && !newPointers[key]:
+				c.Compatibility, c.Reason = Compatible, "receiver changed from pointer to value"
+			default:
+				c.Compatibility, c.Reason = Compatible, "only parameter names changed"
+			}
+		case Added:
+			c.Compatibility, c.Reason = Compatible, "added"
+			if change.Element == ElementInterfaceMethod || change.Element == ElementEmbedded {
+				if sealed(oldIfaces[memberKey(change.Package, change.Type)]) {
+					c.Reason = "added to an interface that cannot be implemented outside its package"
+				} else {
+					c.Compatibility = Breaking
+					c.Reason = "implementations outside the package no longer satisfy the interface"
+				}
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// HasBreaking reports whether any of the changes is breaking.
+func HasBreaking(changes []APIChange) bool {
+	for _, c := range changes {
+		if c.Compatibility == Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPI reports whether a change touches the exported API.
+func isAPI(c Change) bool {
+	if c.Package == "main" || strings.HasSuffix(c.Package, "_test") {
+		return false
+	}
+	switch c.Element {
+	case ElementType, ElementInterface:
+		return token.IsExported(c.Type)
+	case ElementField, ElementMethod:
+		return token.IsExported(c.Type) && token.IsExported(c.Name)
+	case ElementInterfaceMethod:
+		// Adding an unexported method seals the interface, which breaks
+		// implementations elsewhere; removing one is invisible.
+		return token.IsExported(c.Type) && (token.IsExported(c.Name) || c.Kind == Added)
+	case ElementEmbedded:
+		return token.IsExported(c.Type)
+	case ElementFunction:
+		return token.IsExported(c.Name)
+	}
+	return false
+}
+
+// sealed reports whether an interface has an unexported method.
+func sealed(iface Interface) bool {
+	for _, method := range iface.Methods {
+		if !token.IsExported(method.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiSignatures maps every method and function to its signature without
+// parameter names, which callers never see, and reports which methods have
+// a pointer receiver.
+func apiSignatures(model *ClientStruct) (sigs map[string]string, pointers map[string]bool) {
+	sigs, pointers = map[string]string{}, map[string]bool{}
+	if model == nil {
+		return sigs, pointers
+	}
+	add := func(pkg, typeName string, methods []Method) {
+		for _, method := range methods {
+			key := strings.Join([]string{pkg, typeName, method.Name}, "\x00")
+			sigs[key] = signature(unnamed(method.Parameters), method.ReturnType)
+			pointers[key] = method.Pointer
+		}
+	}
+	for _, pkg := range model.Packages {
+		for _, file := range pkg.Files {
+			for _, st := range file.Structs {
+				add(pkg.Name, st.Name, st.Methods)
+			}
+			for _, iface := range file.Interfaces {
+				add(pkg.Name, iface.Name, iface.Methods)
+			}
+		}
+	}
+	for _, fn := range model.GlobalFunctions {
+		key := strings.Join([]string{fn.Package, "", fn.Name}, "\x00")
+		sigs[key] = signature(unnamed(fn.Parameters), fn.ReturnType)
+	}
+	return sigs, pointers
+}
+
+func unnamed(params []Parameter) []Parameter {
+	types := make([]Parameter, 0, len(params))
+	for _, param := range params {
+		types = append(types, Parameter{Type: param.Type})
+	}
+	return types
+}
@@ -0,0 +1,176 @@
+package parse
+
+import (
+	"context"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// modelOf builds the model of a single file of package p.
+func modelOf(t *testing.T, src string) *ClientStruct {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", "package p\n\n"+src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, edges, functions := GetStructsFile(fset, f, "p.go", "p")
+	return &ClientStruct{
+		Packages:        []Package{{Name: "p", Files: []File{file}}},
+		Edges:           edges,
+		GlobalFunctions: functions,
+	}
+}
+
+// dirModel builds the model of a directory holding files, by
+// slash-separated name, with a Parser.
+func dirModel(t *testing.T, files map[string]string) *ClientStruct {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	model, _, err := NewParser().ParseDir(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model
+}
+
+// apiReport formats the API changes between two models, one per line.
+func apiReport(oldModel, newModel *ClientStruct) string {
+	var lines []string
+	for _, c := range APIDiff(oldModel, newModel) {
+		lines = append(lines, c.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestAPIDiffMethods(t *testing.T) {
+	const s = "package p\n\ntype S struct{ N int }\n"
+	tests := []struct {
+		name     string
+		old, new map[string]string
+		want     string
+	}{
+		{
+			name: "method in another file removed",
+			old:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n"},
+			new:  map[string]string{"s.go": s},
+			want: "breaking: - method p.S.Get: (*S).Get() int (removed)",
+		},
+		{
+			name: "method in another file changed",
+			old:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n"},
+			new:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s *S) Get() int64 { return int64(s.N) }\n"},
+			want: "breaking: ~ method p.S.Get: (*S).Get() int -> (*S).Get() int64 (signature changed)",
+		},
+		{
+			name: "method declared before its struct added",
+			old:  map[string]string{"s.go": s},
+			new:  map[string]string{"s.go": "package p\n\nfunc (s S) Get() int { return s.N }\n\ntype S struct{ N int }\n"},
+			want: "compatible: + method p.S.Get: S.Get() int (added)",
+		},
+		{
+			name: "value to pointer receiver",
+			old:  map[string]string{"s.go": s + "\nfunc (s S) Get() int { return s.N }\n"},
+			new:  map[string]string{"s.go": s + "\nfunc (s *S) Get() int { return s.N }\n"},
+			want: "breaking: ~ method p.S.Get: S.Get() int -> (*S).Get() int (receiver changed from value to pointer)",
+		},
+		{
+			name: "pointer to value receiver",
+			old:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n"},
+			new:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s S) Get() int { return s.N }\n"},
+			want: "compatible: ~ method p.S.Get: (*S).Get() int -> S.Get() int (receiver changed from pointer to value)",
+		},
+		{
+			name: "method moved to another file",
+			old:  map[string]string{"s.go": s + "\nfunc (s *S) Get() int { return s.N }\n"},
+			new:  map[string]string{"s.go": s, "m.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n"},
+		},
+	}
+	for _, test := range tests {
+		if got := apiReport(dirModel(t, test.old), dirModel(t, test.new)); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAPIDiffEmbedded(t *testing.T) {
+	const base = "type Base struct{}\n\ntype base struct{}\n\n"
+	tests := []struct {
+		name     string
+		old, new string
+		want     []string
+	}{
+		{
+			name: "removed",
+			old:  "type S struct {\n\tBase\n\tN int\n}",
+			new:  "type S struct {\n\tN int\n}",
+			want: []string{"breaking: - field p.S.Base: Base (removed)"},
+		},
+		{
+			name: "pointer",
+			old:  "type S struct{ Base }",
+			new:  "type S struct{ *Base }",
+			want: []string{"breaking: ~ field p.S.Base: Base -> *Base (field type changed)"},
+		},
+		{
+			name: "qualified",
+			old:  "type S struct{ *Base }",
+			new:  "type S struct{ *strings.Builder }",
+			want: []string{"compatible: + field p.S.Builder: *strings.Builder (added)", "breaking: - field p.S.Base: *Base (removed)"},
+		},
+		{
+			name: "added",
+			old:  "type S struct{ N int }",
+			new:  "type S struct {\n\tBase\n\tN int\n}",
+			want: []string{"compatible: + field p.S.Base: Base (added)"},
+		},
+		{
+			name: "unexported",
+			old:  "type S struct{ base }",
+			new:  "type S struct{}",
+		},
+		{
+			name: "generic",
+			old:  "type S struct{ G[int] }\n\ntype G[T any] struct{}",
+			new:  "type S struct{ G[string] }\n\ntype G[T any] struct{}",
+			want: []string{"breaking: ~ field p.S.G: G[int] -> G[string] (field type changed)"},
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, c := range APIDiff(modelOf(t, base+test.old), modelOf(t, base+test.new)) {
+			got = append(got, c.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestGetStructsFileEmbedded(t *testing.T) {
+	model := modelOf(t, "type S struct {\n\tio.Reader\n\t*Base\n\tN, M int\n\tG[int]\n}")
+	st := model.Packages[0].Files[0].Structs[0]
+	if got := strings.Join(st.Embedded, " "); got != "io.Reader *Base G[int]" {
+		t.Errorf("embedded = %s", got)
+	}
+	var names []string
+	for _, field := range st.Fields {
+		names = append(names, field.Name)
+	}
+	if got := strings.Join(names, " "); got != "N M" {
+		t.Errorf("fields = %s", got)
+	}
+}
@@ -0,0 +1,198 @@
+package parse
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenArchive opens a .zip, .tar, .tar.gz or .tgz file as an fs.FS, so it
+// can be passed to Load or Parser.ParseFS without unpacking it. A tar
+// archive cannot be read at random, so its Go files are loaded into memory
+// and the other files left out. The closer must be called once the file
+// system is no longer used.
+func OpenArchive(name string) (fs.FS, io.Closer, error) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		r, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening archive %s: %w", name, err)
+		}
+		return r, r, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar"):
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening archive %s: %w", name, err)
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if !strings.HasSuffix(name, ".tar") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error opening archive %s: %w", name, err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+		fsys, err := readTar(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading archive %s: %w", name, err)
+		}
+		return fsys, io.NopCloser(nil), nil
+	}
+	return nil, nil, fmt.Errorf("unsupported archive %s: expected .zip, .tar, .tar.gz or .tgz", name)
+}
+
+// readTar loads the Go files of a tar stream into memory. Other files are
+// skipped unread; the directories holding Go files are created as they are
+// added.
+func readTar(r io.Reader) (*memFS, error) {
+	fsys := newMemFS()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return fsys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := pathpkg.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) || pathpkg.Ext(name) != ".go" {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		fsys.add(name, data, hdr.ModTime)
+	}
+}
+
+// memFS is a read-only in-memory file system.
+type memFS struct {
+	files map[string]*memFile
+	dirs  map[string]map[string]fs.DirEntry
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		files: map[string]*memFile{},
+		dirs:  map[string]map[string]fs.DirEntry{".": {}},
+	}
+}
+
+func (m *memFS) add(name string, data []byte, modTime time.Time) {
+	file := &memFile{name: pathpkg.Base(name), data: data, modTime: modTime}
+	m.files[name] = file
+
+	var entry fs.DirEntry = fs.FileInfoToDirEntry(file)
+	for name != "." {
+		dir := pathpkg.Dir(name)
+		entries, ok := m.dirs[dir]
+		if !ok {
+			entries = map[string]fs.DirEntry{}
+			m.dirs[dir] = entries
+		}
+		entries[pathpkg.Base(name)] = entry
+		if ok {
+			return
+		}
+		entry = fs.FileInfoToDirEntry(memDirInfo(pathpkg.Base(dir)))
+		name = dir
+	}
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if file, ok := m.files[name]; ok {
+		return &openFile{memFile: file, Reader: bytes.NewReader(file.data)}, nil
+	}
+	if entries, ok := m.dirs[name]; ok {
+		list := make([]fs.DirEntry, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, entry)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name() < list[j].Name()
+		})
+		return &openDir{info: memDirInfo(pathpkg.Base(name)), entries: list}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// memFile is a file of a memFS and its own fs.FileInfo.
+type memFile struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() fs.FileMode  { return 0444 }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return false }
+func (f *memFile) Sys() interface{}   { return nil }
+
+type openFile struct {
+	*memFile
+	*bytes.Reader
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) { return f.memFile, nil }
+func (f *openFile) Close() error               { return nil }
+
+type memDirInfo string
+
+func (d memDirInfo) Name() string       { return string(d) }
+func (d memDirInfo) Size() int64        { return 0 }
+func (d memDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d memDirInfo) ModTime() time.Time { return time.Time{} }
+func (d memDirInfo) IsDir() bool        { return true }
+func (d memDirInfo) Sys() interface{}   { return nil }
+
+type openDir struct {
+	info    memDirInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openDir) Close() error               { return nil }
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: string(d.info), Err: errors.New("is a directory")}
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
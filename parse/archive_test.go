@@ -0,0 +1,58 @@
+package parse
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestReadTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(hdr *tar.Header, content string) {
+		hdr.Size = int64(len(content))
+		hdr.ModTime = time.Unix(1700000000, 0)
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&tar.Header{Name: "mod/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	write(&tar.Header{Name: "mod/go.mod", Typeflag: tar.TypeReg}, "module m\n")
+	write(&tar.Header{Name: "mod/a.go", Typeflag: tar.TypeReg}, "package a\n")
+	write(&tar.Header{Name: "mod/testdata/big.bin", Typeflag: tar.TypeReg}, strings.Repeat("x", 1<<20))
+	write(&tar.Header{Name: "mod/assets/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	write(&tar.Header{Name: "/mod/sub/deep/b.go", Typeflag: tar.TypeReg}, "package deep\n")
+	write(&tar.Header{Name: "mod/link.go", Typeflag: tar.TypeSymlink, Linkname: "a.go"}, "")
+	write(&tar.Header{Name: "../evil.go", Typeflag: tar.TypeReg}, "package evil\n")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := readTar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for name := range fsys.files {
+		files = append(files, name)
+	}
+	if len(files) != 2 {
+		t.Errorf("loaded %v, want mod/a.go and mod/sub/deep/b.go", files)
+	}
+	if err := fstest.TestFS(fsys, "mod/a.go", "mod/sub/deep/b.go"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat(fsys, "mod/testdata"); err == nil {
+		t.Error("directory without Go files was created")
+	}
+}
@@ -0,0 +1,175 @@
+package parse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version identifies the format of the parse results. Bump it whenever
+// GetStructsFile produces different output, or ClientStruct or the types it
+// holds change, so that persisted caches written by older builds are not
+// reused.
+const Version = "7"
+
+// Entries unused for cacheMaxAge are pruned, and the least recently used
+// ones go first while the cache holds more than cacheMaxSize bytes.
+const (
+	cacheMaxAge  = 30 * 24 * time.Hour
+	cacheMaxSize = 256 << 20
+)
+
+// cachedFile is the persisted form of a fileResult. The AST is not stored;
+// it is parsed again from disk when the file is about to be written. Type
+// information is not stored either: operations that need it load the
+// packages through the go command, whose own build cache serves them.
+type cachedFile struct {
+	Package   string       `json:"package"`
+	File      File         `json:"file"`
+	Edges     []Edge       `json:"edges"`
+	Functions []Function   `json:"functions"`
+	Methods   []recvMethod `json:"methods"`
+}
+
+// diskCache persists successful parse results in a directory, keyed by
+// file path, the directory of the file relative to the parsed root, which
+// the entity IDs depend on, content hash, Go version and Version. The
+// modification time of an entry is the time it was last used.
+type diskCache struct {
+	dir string
+}
+
+func (c *diskCache) key(fname, dir string, hash [sha256.Size]byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%x", Version, runtime.Version(), fname, dir, hash)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// load returns the cached result for key. Any problem reading the entry is
+// treated as a miss.
+func (c *diskCache) load(key string) (*fileResult, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var cached cachedFile
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	return &fileResult{
+		packageName: cached.Package,
+		file:        cached.File,
+		edges:       cached.Edges,
+		functions:   cached.Functions,
+		methods:     cached.Methods,
+	}, true
+}
+
+// store writes result under key. The entry is written to a temporary file
+// first so that a reader never sees a partial entry.
+func (c *diskCache) store(key string, result *fileResult) error {
+	data, err := json.Marshal(cachedFile{
+		Package:   result.packageName,
+		File:      result.file,
+		Edges:     result.edges,
+		Functions: result.functions,
+		Methods:   result.methods,
+	})
+	if err != nil {
+		return err
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// prune removes the entries last used before maxAge ago, then the least
+// recently used ones until the rest fit in maxSize bytes. Temporary files
+// left by an interrupted store are removed once they are an hour old.
+func (c *diskCache) prune(maxAge time.Duration, maxSize int64) error {
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var entries []entry
+	var total int64
+	now := time.Now()
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		age := now.Sub(info.ModTime())
+		switch {
+		case strings.HasSuffix(path, ".tmp"):
+			if age > time.Hour {
+				os.Remove(path)
+			}
+		case filepath.Ext(path) != ".json":
+		case age > maxAge:
+			os.Remove(path)
+		default:
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mtime.Before(entries[j].mtime)
+	})
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePrune(t *testing.T) {
+	c := &diskCache{dir: t.TempDir()}
+	now := time.Now()
+	store := func(name string, age time.Duration) string {
+		key := c.key(name, ".", sha256.Sum256([]byte(name)))
+		if err := c.store(key, &fileResult{packageName: "p", file: File{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(c.path(key), now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	stale := store("stale.go", 40*24*time.Hour)
+	old := store("old.go", 3*time.Hour)
+	used := store("used.go", 4*time.Hour)
+	recent := store("recent.go", time.Hour)
+
+	// Loading an entry marks it as used.
+	if _, ok := c.load(used); !ok {
+		t.Fatal("entry not loaded")
+	}
+	tmp := filepath.Join(filepath.Dir(c.path(recent)), recent+".1.tmp")
+	if err := os.WriteFile(tmp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(c.path(recent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two entries: the stale one goes by age, then the least
+	// recently used one by size.
+	if err := c.prune(30*24*time.Hour, 2*info.Size()); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{stale: false, old: false, used: true, recent: true} {
+		if _, err := os.Stat(c.path(key)); (err == nil) != want {
+			t.Errorf("entry kept = %v, want %v", err == nil, want)
+		}
+	}
+	if _, err := os.Stat(tmp); err == nil {
+		t.Error("temporary file kept")
+	}
+
+	// A cache that was never written to is nothing to prune.
+	if err := (&diskCache{dir: filepath.Join(c.dir, "none")}).prune(time.Hour, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+// cachedParse parses dir with a new Parser using cacheDir and returns the
+// model as JSON and the names of the files it parsed.
+func cachedParse(t *testing.T, dir, cacheDir string) (string, []string) {
+	t.Helper()
+	var logged bytes.Buffer
+	p := NewParser()
+	p.SetLogger(log.New(&logged, "", 0))
+	p.SetCacheDir(cacheDir)
+	model, _, err := p.ParseDir(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []string
+	for _, line := range strings.Split(logged.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "Parsed file: "); ok {
+			parsed = append(parsed, filepath.Base(name))
+		}
+	}
+	sort.Strings(parsed)
+	return string(data), parsed
+}
+
+func TestCacheAcrossParsers(t *testing.T) {
+	dir, cacheDir := t.TempDir(), t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.go", "package p\n\ntype A struct{ B *B }\n")
+	write("b.go", "package p\n\ntype B struct{ N int }\n")
+
+	first, parsed := cachedParse(t, dir, cacheDir)
+	if strings.Join(parsed, " ") != "a.go b.go" {
+		t.Fatalf("first parse parsed %v", parsed)
+	}
+
+	// Another parser finds everything on disk.
+	model, parsed := cachedParse(t, dir, cacheDir)
+	if len(parsed) != 0 {
+		t.Errorf("parsed %v again", parsed)
+	}
+	if model != first {
+		t.Errorf("model from the cache\n%s\nwant\n%s", model, first)
+	}
+
+	// A changed file misses the cache.
+	write("b.go", "package p\n\ntype B struct{ M string }\n")
+	model, parsed = cachedParse(t, dir, cacheDir)
+	if strings.Join(parsed, " ") != "b.go" {
+		t.Errorf("after a change parsed %v, want b.go", parsed)
+	}
+	if !strings.Contains(model, `"M"`) || strings.Contains(model, `"N"`) {
+		t.Errorf("model after a change:\n%s", model)
+	}
+	changed := model
+
+	// Corrupt entries are parsed again and replaced.
+	err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && filepath.Ext(path) == ".json" {
+			err = os.WriteFile(path, []byte(`{"file": 1`), 0644)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, parsed = cachedParse(t, dir, cacheDir)
+	if strings.Join(parsed, " ") != "a.go b.go" {
+		t.Errorf("with corrupt entries parsed %v", parsed)
+	}
+	if model != changed {
+		t.Errorf("model with corrupt entries\n%s\nwant\n%s", model, changed)
+	}
+	if _, parsed = cachedParse(t, dir, cacheDir); len(parsed) != 0 {
+		t.Errorf("corrupt entries not replaced: parsed %v", parsed)
+	}
+}
@@ -0,0 +1,189 @@
+package parse
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// CheckEdits type-checks the packages the edits touch, and the packages of
+// pkgs and their tests, which may import them, with the new file contents
+// laid over the disk, and returns the errors the edits introduce. Errors the
+// packages already had are not reported. Nothing is written.
+func CheckEdits(ctx context.Context, pkgs map[string]*ast.Package, edits []FileEdit) ([]Diagnostic, error) {
+	if len(edits) == 0 {
+		return nil, nil
+	}
+	overlay := make(map[string][]byte, len(edits))
+	dirs, newDirs := map[string]bool{}, map[string]bool{}
+	for _, edit := range edits {
+		name, err := filepath.Abs(edit.Name)
+		if err != nil {
+			return nil, err
+		}
+		overlay[name] = edit.New
+		if dir := filepath.Dir(name); existingDir(dir) == dir {
+			dirs[dir] = true
+		} else {
+			newDirs[dir] = true
+		}
+	}
+	for _, p := range pkgs {
+		for fname := range p.Files {
+			abs, err := filepath.Abs(fname)
+			if err != nil {
+				return nil, err
+			}
+			if dir := filepath.Dir(abs); existingDir(dir) == dir {
+				dirs[dir] = true
+			}
+		}
+	}
+
+	var diagnostics []Diagnostic
+	// Packages the edits create had no errors before.
+	for _, dir := range sortedKeys(newDirs) {
+		after, err := typeErrors(ctx, []string{dir}, overlay)
+		if err != nil {
+			return nil, err
+		}
+		diagnostics = append(diagnostics, after...)
+	}
+	if len(dirs) == 0 {
+		return diagnostics, nil
+	}
+	before, err := typeErrors(ctx, sortedKeys(dirs), nil)
+	if err != nil {
+		return nil, err
+	}
+	after, err := typeErrors(ctx, sortedKeys(dirs), overlay)
+	if err != nil {
+		return nil, err
+	}
+
+	// Positions move with the edit, so errors are matched by file and
+	// message only.
+	known := map[string]int{}
+	for _, d := range before {
+		known[d.File+"\x00"+d.Message]++
+	}
+	for _, d := range after {
+		key := d.File + "\x00" + d.Message
+		if known[key] > 0 {
+			known[key]--
+			continue
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics, nil
+}
+
+// typeErrors loads the packages in dirs with their test variants and returns
+// their parse and type errors. A directory may exist only in the overlay, in
+// which case it is loaded from its closest existing parent; such a directory
+// is loaded on its own.
+func typeErrors(ctx context.Context, dirs []string, overlay map[string][]byte) ([]Diagnostic, error) {
+	base := existingDir(dirs[0])
+	patterns := make([]string, len(dirs))
+	for i, dir := range dirs {
+		if dir == existingDir(dir) {
+			patterns[i] = dir
+			continue
+		}
+		rel, err := filepath.Rel(base, dir)
+		if err != nil {
+			return nil, err
+		}
+		patterns[i] = "./" + filepath.ToSlash(rel)
+	}
+
+	// Dependencies are type-checked from source too: their export data
+	// comes from the installed go command and may be in a format this
+	// version of go/packages cannot read.
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes | packages.NeedImports | packages.NeedDeps,
+		Dir:     base,
+		Tests:   true,
+		Overlay: overlay,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %w", strings.Join(dirs, ", "), err)
+	}
+
+	var diagnostics []Diagnostic
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		repeated := false
+		for _, e := range pkg.Errors {
+			// List errors come from the go command, about the module setup
+			// or its own build of the overlay; edits show up as parse and
+			// type errors.
+			if e.Kind == packages.ListError {
+				continue
+			}
+			// go/types reports related positions, such as "other
+			// declaration of", as indented follow-up errors.
+			if strings.HasPrefix(e.Msg, "\t") {
+				if !repeated && len(diagnostics) > 0 {
+					diagnostics[len(diagnostics)-1].Message += "\n" + e.Msg
+				}
+				continue
+			}
+			d := Diagnostic{Message: e.Msg}
+			d.File, d.Line, d.Column = splitPos(e.Pos)
+			// Test variants repeat the errors of the package they extend.
+			key := fmt.Sprintf("%s:%d:%d:%s", d.File, d.Line, d.Column, d.Message)
+			repeated = seen[key]
+			if !repeated {
+				seen[key] = true
+				diagnostics = append(diagnostics, d)
+			}
+		}
+	}
+	return diagnostics, nil
+}
+
+// splitPos splits a packages.Error position, "file:line:col", "file:line",
+// "file" or "-".
+func splitPos(pos string) (file string, line, column int) {
+	if pos == "-" {
+		return "", 0, 0
+	}
+	var nums []int
+	for len(nums) < 2 {
+		i := strings.LastIndexByte(pos, ':')
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(pos[i+1:])
+		if err != nil {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		pos = pos[:i]
+	}
+	switch len(nums) {
+	case 2:
+		return pos, nums[0], nums[1]
+	case 1:
+		return pos, nums[0], 0
+	}
+	return pos, 0, 0
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
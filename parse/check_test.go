@@ -0,0 +1,95 @@
+package parse
+
+import (
+	"context"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkModule is a module in which b and the tests of a use package a, and
+// c and the file a/old.go already have type errors.
+var checkModule = map[string]string{
+	"go.mod":      "module m\n\ngo 1.21\n",
+	"a/a.go":      "package a\n\ntype T struct{ N int }\n",
+	"a/old.go":    "package a\n\nvar broken int = \"s\"\n",
+	"a/a_test.go": "package a_test\n\nimport (\n\t\"testing\"\n\n\t\"m/a\"\n)\n\nfunc TestT(t *testing.T) { _ = a.T{N: 1} }\n",
+	"b/b.go":      "package b\n\nimport \"m/a\"\n\nvar V = a.T{N: 1}\n",
+	"c/c.go":      "package c\n\nvar Broken int = \"s\"\n",
+}
+
+// checkReport runs CheckEdits on the edits, given by slash-separated name,
+// and returns the diagnostics as "file: message" relative to dir, sorted.
+func checkReport(t *testing.T, dir string, pkgs map[string]*ast.Package, edits map[string]string) []string {
+	t.Helper()
+	var fileEdits []FileEdit
+	for name, content := range edits {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		old, err := os.ReadFile(path)
+		if err != nil {
+			old = nil
+		}
+		fileEdits = append(fileEdits, FileEdit{Name: path, Old: old, New: []byte(content)})
+	}
+	diagnostics, err := CheckEdits(context.Background(), pkgs, fileEdits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diagnostics {
+		rel, err := filepath.Rel(dir, d.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel)+": "+strings.SplitN(d.Message, "\n", 2)[0])
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestCheckEdits(t *testing.T) {
+	dir, pkgs := writeModule(t, checkModule)
+	tests := []struct {
+		name  string
+		edits map[string]string
+		want  []string
+	}{
+		{
+			name:  "harmless",
+			edits: map[string]string{"a/a.go": "package a\n\ntype T struct {\n\tN int\n\tM int\n}\n"},
+		},
+		{
+			name:  "breaks dependents",
+			edits: map[string]string{"a/a.go": "package a\n\ntype T struct{ Count int }\n"},
+			want: []string{
+				"a/a_test.go: unknown field N in struct literal of type a.T",
+				"b/b.go: unknown field N in struct literal of type a.T",
+			},
+		},
+		{
+			// The old error moves down a line; it is matched by file and
+			// message, not position.
+			name:  "existing error moved",
+			edits: map[string]string{"a/old.go": "package a\n\n// broken is broken.\nvar broken int = \"s\"\n"},
+		},
+		{
+			name:  "existing error repeated",
+			edits: map[string]string{"c/c.go": "package c\n\nvar Broken int = \"s\"\n\nvar Again int = \"s\"\n"},
+			want:  []string{`c/c.go: cannot use "s" (untyped string constant) as int value in variable declaration`},
+		},
+		{
+			name:  "new package",
+			edits: map[string]string{"d/d.go": "package d\n\nvar D = undefined\n"},
+			want:  []string{"d/d.go: undefined: undefined"},
+		},
+	}
+	for _, test := range tests {
+		got := checkReport(t, dir, pkgs, test.edits)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
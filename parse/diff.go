@@ -0,0 +1,385 @@
+package parse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeKind says whether an element was added, removed or changed.
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Element is the kind of model element a Change is about.
+type Element string
+
+const (
+	ElementType            Element = "type"
+	ElementField           Element = "field"
+	ElementMethod          Element = "method"
+	ElementInterface       Element = "interface"
+	ElementInterfaceMethod Element = "interface method"
+	ElementEmbedded        Element = "embedded"
+	ElementFunction        Element = "function"
+	ElementEdge            Element = "edge"
+)
+
+// Change is one structural difference between two models. Package and Type
+// locate the element; Name is the field, method or function name, or the
+// target of an edge. Old and New hold the signature before and after.
+type Change struct {
+	Kind    ChangeKind `json:"kind"`
+	Element Element    `json:"element"`
+	Package string     `json:"package"`
+	Type    string     `json:"type,omitempty"`
+	Name    string     `json:"name,omitempty"`
+	Old     string     `json:"old,omitempty"`
+	New     string     `json:"new,omitempty"`
+}
+
+// Diff is the list of changes between two models, in a stable order.
+type Diff struct {
+	Changes []Change `json:"changes"`
+}
+
+// String formats the change as one line of the text report, e.g.
+// "~ method parse.Parser.Refresh: (*Parser).Refresh(ctx context.Context) error -> (*Parser).Refresh(ctx context.Context) (*Model, error)".
+func (c Change) String() string {
+	mark := map[ChangeKind]string{Added: "+", Removed: "-", Changed: "~"}[c.Kind]
+	line := fmt.Sprintf("%s %s %s", mark, c.Element, c.path())
+	switch c.Kind {
+	case Added:
+		if c.New != "" {
+			line += ": " + c.New
+		}
+	case Removed:
+		if c.Old != "" {
+			line += ": " + c.Old
+		}
+	case Changed:
+		line += ": " + c.Old + " -> " + c.New
+	}
+	return line
+}
+
+func (c Change) path() string {
+	switch c.Element {
+	case ElementType, ElementInterface, ElementEmbedded:
+		return c.Package + "." + c.Type
+	case ElementEdge:
+		return c.Package + "." + c.Type + " -> " + c.Name
+	}
+	if c.Type == "" {
+		return c.Package + "." + c.Name
+	}
+	return c.Package + "." + c.Type + "." + c.Name
+}
+
+// DiffModels compares two models by package, type and member names. File
+// names are ignored, so models of the same code read from a directory, an
+// archive or a git revision compare equal, and moving a type between files
+// is not a change.
+func DiffModels(oldModel, newModel *ClientStruct) *Diff {
+	d := &Diff{Changes: []Change{}}
+
+	oldTypes, newTypes := indexTypes(oldModel), indexTypes(newModel)
+	for _, key := range unionKeys(oldTypes, newTypes) {
+		pkg, name := splitKey(key)
+		oldType, inOld := oldTypes[key]
+		newType, inNew := newTypes[key]
+		switch {
+		case !inOld:
+			d.add(Change{Kind: Added, Element: ElementType, Package: pkg, Type: name})
+		case !inNew:
+			d.add(Change{Kind: Removed, Element: ElementType, Package: pkg, Type: name})
+		default:
+			d.diffMembers(ElementField, pkg, name, fieldSignatures(oldType), fieldSignatures(newType))
+			d.diffMembers(ElementMethod, pkg, name, receiverSignatures(oldType), receiverSignatures(newType))
+		}
+	}
+
+	oldIfaces, newIfaces := indexInterfaces(oldModel), indexInterfaces(newModel)
+	for _, key := range unionKeys(oldIfaces, newIfaces) {
+		pkg, name := splitKey(key)
+		oldIface, inOld := oldIfaces[key]
+		newIface, inNew := newIfaces[key]
+		switch {
+		case !inOld:
+			d.add(Change{Kind: Added, Element: ElementInterface, Package: pkg, Type: name})
+		case !inNew:
+			d.add(Change{Kind: Removed, Element: ElementInterface, Package: pkg, Type: name})
+		default:
+			d.diffMembers(ElementInterfaceMethod, pkg, name, methodSignatures(oldIface.Methods), methodSignatures(newIface.Methods))
+			d.diffMembers(ElementEmbedded, pkg, name, embeddedNames(oldIface), embeddedNames(newIface))
+		}
+	}
+
+	oldFuncs, newFuncs := indexFunctions(oldModel), indexFunctions(newModel)
+	for _, key := range unionKeys(oldFuncs, newFuncs) {
+		pkg, name := splitKey(key)
+		oldSig, inOld := oldFuncs[key]
+		newSig, inNew := newFuncs[key]
+		change := Change{Element: ElementFunction, Package: pkg, Name: name, Old: oldSig, New: newSig}
+		switch {
+		case !inOld:
+			change.Kind = Added
+		case !inNew:
+			change.Kind = Removed
+		case oldSig != newSig:
+			change.Kind = Changed
+		default:
+			continue
+		}
+		d.add(change)
+	}
+
+	oldEdges, newEdges := indexEdges(oldModel), indexEdges(newModel)
+	for _, key := range unionKeys(oldEdges, newEdges) {
+		edge := oldEdges[key]
+		kind := Removed
+		if _, inOld := oldEdges[key]; !inOld {
+			edge, kind = newEdges[key], Added
+		} else if _, inNew := newEdges[key]; inNew {
+			continue
+		}
+		d.add(Change{
+			Kind:    kind,
+			Element: ElementEdge,
+			Package: edge.From.PackageName,
+			Type:    edge.From.StructName,
+			Name:    edge.To.PackageName + "." + edge.To.StructName,
+			Old:     edgeField(kind == Removed, edge),
+			New:     edgeField(kind == Added, edge),
+		})
+	}
+
+	return d
+}
+
+func (d *Diff) add(c Change) {
+	d.Changes = append(d.Changes, c)
+}
+
+// diffMembers reports the fields or methods of one type that differ.
+// Members are matched by name, in the order of the new model followed by
+// those only in the old one.
+func (d *Diff) diffMembers(element Element, pkg, typeName string, oldSigs, newSigs []member) {
+	oldByName := make(map[string]string, len(oldSigs))
+	for _, m := range oldSigs {
+		oldByName[m.name] = m.sig
+	}
+	newByName := make(map[string]string, len(newSigs))
+	for _, m := range newSigs {
+		newByName[m.name] = m.sig
+	}
+
+	for _, m := range newSigs {
+		oldSig, ok := oldByName[m.name]
+		change := Change{Element: element, Package: pkg, Type: typeName, Name: m.name, Old: oldSig, New: m.sig}
+		switch {
+		case !ok:
+			change.Kind = Added
+		case oldSig != m.sig:
+			change.Kind = Changed
+		default:
+			continue
+		}
+		d.add(change)
+	}
+	for _, m := range oldSigs {
+		if _, ok := newByName[m.name]; !ok {
+			d.add(Change{Kind: Removed, Element: element, Package: pkg, Type: typeName, Name: m.name, Old: m.sig})
+		}
+	}
+}
+
+// memberKey identifies a type or function across models by package and
+// name.
+func memberKey(pkg, name string) string {
+	return pkg + "\x00" + name
+}
+
+func splitKey(key string) (pkg, name string) {
+	pkg, name, _ = strings.Cut(key, "\x00")
+	return pkg, name
+}
+
+type member struct {
+	name string
+	sig  string
+}
+
+func indexTypes(model *ClientStruct) map[string]Struct {
+	index := map[string]Struct{}
+	if model == nil {
+		return index
+	}
+	for _, pkg := range model.Packages {
+		for _, file := range pkg.Files {
+			for _, st := range file.Structs {
+				key := memberKey(pkg.Name, st.Name)
+				if _, ok := index[key]; !ok {
+					index[key] = st
+				}
+			}
+		}
+	}
+	return index
+}
+
+func indexInterfaces(model *ClientStruct) map[string]Interface {
+	index := map[string]Interface{}
+	if model == nil {
+		return index
+	}
+	for _, pkg := range model.Packages {
+		for _, file := range pkg.Files {
+			for _, iface := range file.Interfaces {
+				key := memberKey(pkg.Name, iface.Name)
+				if _, ok := index[key]; !ok {
+					index[key] = iface
+				}
+			}
+		}
+	}
+	return index
+}
+
+func indexFunctions(model *ClientStruct) map[string]string {
+	index := map[string]string{}
+	if model == nil {
+		return index
+	}
+	for _, fn := range model.GlobalFunctions {
+		key := memberKey(fn.Package, fn.Name)
+		if _, ok := index[key]; !ok {
+			index[key] = signature(fn.Parameters, fn.ReturnType)
+		}
+	}
+	return index
+}
+
+// indexEdges keys edges by their endpoints without file names.
+func indexEdges(model *ClientStruct) map[string]Edge {
+	index := map[string]Edge{}
+	if model == nil {
+		return index
+	}
+	for _, edge := range model.Edges {
+		if edge.From == nil || edge.To == nil {
+			continue
+		}
+		key := strings.Join([]string{
+			edge.From.PackageName, edge.From.StructName, edge.From.FieldTypeName,
+			edge.To.PackageName, edge.To.StructName,
+		}, "\x00")
+		index[key] = edge
+	}
+	return index
+}
+
+func edgeField(set bool, edge Edge) string {
+	if !set {
+		return ""
+	}
+	return "via " + edge.From.FieldTypeName
+}
+
+// embeddedNames lists the embedded types of an interface; the name is the
+// whole signature, so they are only ever added or removed.
+func embeddedNames(iface Interface) []member {
+	members := make([]member, 0, len(iface.Embedded))
+	for _, embedded := range iface.Embedded {
+		members = append(members, member{name: embedded, sig: embedded})
+	}
+	return members
+}
+
+// fieldSignatures lists the fields of a struct, the embedded ones under the
+// name Go gives them, so that replacing Base with *Base is a type change.
+func fieldSignatures(st Struct) []member {
+	members := make([]member, 0, len(st.Fields)+len(st.Embedded))
+	for _, field := range st.Fields {
+		members = append(members, member{name: field.Name, sig: field.Type.Literal})
+	}
+	for _, embedded := range st.Embedded {
+		members = append(members, member{name: embeddedFieldName(embedded), sig: embedded})
+	}
+	return members
+}
+
+// embeddedFieldName returns the name of the field that embeds typ: the type
+// name without pointer, package qualifier or type arguments.
+func embeddedFieldName(typ string) string {
+	typ = strings.TrimPrefix(typ, "*")
+	if i := strings.Index(typ, "["); i >= 0 {
+		typ = typ[:i]
+	}
+	return typ[strings.LastIndex(typ, ".")+1:]
+}
+
+// receiverSignatures lists the methods of a struct as method expressions,
+// e.g. "S.Get() int" or "(*S).Get() int", so that a change of receiver is a
+// change of signature.
+func receiverSignatures(st Struct) []member {
+	members := make([]member, 0, len(st.Methods))
+	for _, method := range st.Methods {
+		recv := st.Name
+		if method.Pointer {
+			recv = "(*" + st.Name + ")"
+		}
+		members = append(members, member{name: method.Name, sig: recv + "." + method.Name + signature(method.Parameters, method.ReturnType)})
+	}
+	return members
+}
+
+func methodSignatures(methods []Method) []member {
+	members := make([]member, 0, len(methods))
+	for _, method := range methods {
+		members = append(members, member{name: method.Name, sig: signature(method.Parameters, method.ReturnType)})
+	}
+	return members
+}
+
+// signature formats parameters and results the way they read in source,
+// e.g. "(ctx context.Context, path string) (*Model, error)".
+func signature(params []Parameter, results []Type) string {
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		parts = append(parts, strings.TrimSpace(param.Name+" "+param.Type.Literal))
+	}
+	sig := "(" + strings.Join(parts, ", ") + ")"
+
+	switch len(results) {
+	case 0:
+	case 1:
+		sig += " " + results[0].Literal
+	default:
+		literals := make([]string, 0, len(results))
+		for _, result := range results {
+			literals = append(literals, result.Literal)
+		}
+		sig += " (" + strings.Join(literals, ", ") + ")"
+	}
+	return sig
+}
+
+// unionKeys returns the keys of both maps in sorted order.
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
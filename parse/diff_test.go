@@ -0,0 +1,69 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestDiffMethodsAcrossFiles diffs models of a type whose methods are
+// declared in files other than its own.
+func TestDiffMethodsAcrossFiles(t *testing.T) {
+	const s = "package p\n\ntype S struct{ N int }\n"
+	base := map[string]string{
+		"s.go":   s,
+		"get.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n",
+	}
+	with := func(files map[string]string) map[string]string {
+		merged := map[string]string{}
+		for name, content := range base {
+			merged[name] = content
+		}
+		for name, content := range files {
+			if content == "" {
+				delete(merged, name)
+			} else {
+				merged[name] = content
+			}
+		}
+		return merged
+	}
+	tests := []struct {
+		name string
+		new  map[string]string
+		want string
+	}{
+		{
+			name: "added",
+			new:  with(map[string]string{"set.go": "package p\n\nfunc (s *S) Set(n int) { s.N = n }\n"}),
+			want: "+ method p.S.Set: (*S).Set(n int)",
+		},
+		{
+			name: "removed",
+			new:  with(map[string]string{"get.go": ""}),
+			want: "- method p.S.Get: (*S).Get() int",
+		},
+		{
+			name: "re-signed",
+			new:  with(map[string]string{"get.go": "package p\n\nfunc (s *S) Get(def int) int { return s.N + def }\n"}),
+			want: "~ method p.S.Get: (*S).Get() int -> (*S).Get(def int) int",
+		},
+		{
+			name: "moved to the file of the struct",
+			new:  with(map[string]string{"get.go": "", "s.go": s + "\nfunc (s *S) Get() int { return s.N }\n"}),
+		},
+		{
+			name: "struct moved away from its methods",
+			new:  with(map[string]string{"s.go": "package p\n", "t.go": s}),
+		},
+	}
+	oldModel := dirModel(t, base)
+	for _, test := range tests {
+		var got []string
+		for _, c := range DiffModels(oldModel, dirModel(t, test.new)).Changes {
+			got = append(got, c.String())
+		}
+		if strings.Join(got, "\n") != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), test.want)
+		}
+	}
+}
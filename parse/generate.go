@@ -0,0 +1,479 @@
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Generators lists the code the generate operation can add to a struct, in
+// the order it is added:
+//
+//	constructor   NewX, taking the required fields, see genField.required
+//	accessors     a getter and a setter per field: Name and SetName for a
+//	              field name, GetName and SetName for an exported field Name
+//	string        a String method printing the fields
+//	validate      a Validate method checking the validate tags of the fields
+var Generators = []string{"constructor", "accessors", "string", "validate"}
+
+// genField is a named field of the struct code is generated for. Embedded
+// and blank fields are left out.
+type genField struct {
+	name     string
+	typ      ast.Expr
+	typeText string
+	// rules are the comma-separated rules of the validate tag of the
+	// field, or of its binding tag as gin names it.
+	rules []string
+}
+
+// required reports whether the tag of the field marks it as required.
+func (f genField) required() bool {
+	for _, rule := range f.rules {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// generator generates the code for one struct of a package.
+type generator struct {
+	p      *opPackage
+	ts     *ast.TypeSpec
+	recv   string
+	fields []genField
+	// pointer is set once the struct has methods with pointer receivers,
+	// which String then has too.
+	pointer bool
+}
+
+// generate adds the code of the named generators, all of Generators if names
+// is empty, for the struct ts declared in file. The code is appended to file,
+// or to its sibling _gen.go file if genFile is set, which is created if need
+// be. A constructor, String or Validate that already exists is refused;
+// accessors are only added for the fields that have none.
+func (p *opPackage) generate(file *opFile, ts *ast.TypeSpec, names []string, genFile bool) error {
+	if ts.TypeParams != nil {
+		return fmt.Errorf("struct %s is generic, which generators do not support", ts.Name.Name)
+	}
+	known := map[string]bool{}
+	for _, name := range Generators {
+		known[name] = true
+	}
+	want := known
+	if len(names) > 0 {
+		want = map[string]bool{}
+		for _, name := range names {
+			if !known[name] {
+				return fmt.Errorf("unknown generator %q", name)
+			}
+			want[name] = true
+		}
+	}
+
+	g := &generator{
+		p:    p,
+		ts:   ts,
+		recv: receiverField(ts.Name.Name, methodDecls(file.f, ts.Name.Name)).Names[0].Name,
+	}
+	for _, decls := range p.methods(ts.Name.Name) {
+		for _, decl := range decls {
+			if isPointer(decl.Recv.List[0].Type) {
+				g.pointer = true
+			}
+		}
+	}
+	for _, field := range ts.Type.(*ast.StructType).Fields.List {
+		var rules []string
+		if field.Tag != nil {
+			if tag, err := strconv.Unquote(field.Tag.Value); err == nil {
+				rule, ok := reflect.StructTag(tag).Lookup("validate")
+				if !ok {
+					rule = reflect.StructTag(tag).Get("binding")
+				}
+				if rule != "" {
+					rules = strings.Split(rule, ",")
+				}
+			}
+		}
+		for _, ident := range field.Names {
+			if ident.Name != "_" {
+				g.fields = append(g.fields, genField{
+					name:     ident.Name,
+					typ:      field.Type,
+					typeText: formatExpr(p.fset, field.Type),
+					rules:    rules,
+				})
+			}
+		}
+	}
+
+	var code [][]byte
+	for _, name := range Generators {
+		if !want[name] {
+			continue
+		}
+		var text string
+		var err error
+		switch name {
+		case "constructor":
+			text, err = g.constructor()
+		case "accessors":
+			text = g.accessors()
+			g.pointer = g.pointer || text != ""
+		case "string":
+			text, err = g.stringMethod()
+		case "validate":
+			text, err = g.validate()
+		}
+		if err != nil {
+			return err
+		}
+		if text != "" {
+			code = append(code, []byte(text))
+		}
+	}
+	if len(code) == 0 {
+		return fmt.Errorf("struct %s already has all the accessors to generate", ts.Name.Name)
+	}
+
+	if genFile {
+		var err error
+		if file, err = p.genFile(file); err != nil {
+			return err
+		}
+	}
+	for _, text := range code {
+		file.tail = append(file.tail, text)
+	}
+	return nil
+}
+
+// genFile returns the sibling of file named after it with a _gen.go suffix,
+// adding it to the package if it does not exist yet.
+func (p *opPackage) genFile(file *opFile) (*opFile, error) {
+	name := strings.TrimSuffix(file.name, ".go")
+	if !strings.HasSuffix(name, "_gen") {
+		name += "_gen"
+	}
+	name += ".go"
+	for _, file := range p.files {
+		if file.name == name {
+			return file, nil
+		}
+	}
+	if _, err := os.Stat(name); err == nil {
+		return nil, fmt.Errorf("%s exists but is not part of package %s", filepath.Base(name), p.name)
+	}
+	return p.newFile(name)
+}
+
+// hasMember reports whether the struct has a field or a method named name.
+func (g *generator) hasMember(name string) bool {
+	if field, _ := lookupField(g.ts.Type.(*ast.StructType), name); field != nil {
+		return true
+	}
+	file, _ := g.p.lookupMethod(g.ts.Name.Name, name)
+	return file != nil
+}
+
+// method refuses to generate the method name if the struct already has such
+// a member.
+func (g *generator) method(name string) error {
+	if g.hasMember(name) {
+		return fmt.Errorf("struct %s already has a member %s", g.ts.Name.Name, name)
+	}
+	return nil
+}
+
+func (g *generator) constructor() (string, error) {
+	typeName := g.ts.Name.Name
+	name := "New" + upperInitial(typeName)
+	if g.p.lookupFunc(name) {
+		return "", fmt.Errorf("package %s already has a function %s", g.p.name, name)
+	}
+	// Take the required fields, or all fields if none is marked so.
+	fields := g.fields
+	var required []genField
+	for _, field := range g.fields {
+		if field.required() {
+			required = append(required, field)
+		}
+	}
+	if len(required) > 0 {
+		fields = required
+	}
+
+	var params, values []string
+	taken := map[string]bool{}
+	for _, field := range fields {
+		param := paramName(field.name, taken)
+		params = append(params, param+" "+field.typeText)
+		values = append(values, field.name+": "+param)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s returns a new %s.\n", name, typeName)
+	fmt.Fprintf(&b, "func %s(%s) *%s {\n", name, strings.Join(params, ", "), typeName)
+	fmt.Fprintf(&b, "\treturn &%s{%s}\n}\n", typeName, strings.Join(values, ", "))
+	return b.String(), nil
+}
+
+func (g *generator) accessors() string {
+	var b strings.Builder
+	for _, field := range g.fields {
+		getter := upperInitial(field.name)
+		if getter == field.name {
+			getter = "Get" + getter
+		}
+		setter := "Set" + upperInitial(field.name)
+		if !g.hasMember(getter) {
+			fmt.Fprintf(&b, "// %s returns the %s field of %s.\n", getter, field.name, g.recv)
+			fmt.Fprintf(&b, "func (%s *%s) %s() %s {\n", g.recv, g.ts.Name.Name, getter, field.typeText)
+			fmt.Fprintf(&b, "\treturn %s.%s\n}\n\n", g.recv, field.name)
+		}
+		if !g.hasMember(setter) {
+			param := paramName(field.name, map[string]bool{g.recv: true})
+			fmt.Fprintf(&b, "// %s sets the %s field of %s.\n", setter, field.name, g.recv)
+			fmt.Fprintf(&b, "func (%s *%s) %s(%s %s) {\n", g.recv, g.ts.Name.Name, setter, param, field.typeText)
+			fmt.Fprintf(&b, "\t%s.%s = %s\n}\n\n", g.recv, field.name, param)
+		}
+	}
+	return b.String()
+}
+
+func (g *generator) stringMethod() (string, error) {
+	if err := g.method("String"); err != nil {
+		return "", err
+	}
+	var verbs, args []string
+	for _, field := range g.fields {
+		verb := "%v"
+		if valueKind(field.typ) == "string" {
+			verb = "%q"
+		}
+		verbs = append(verbs, field.name+": "+verb)
+		args = append(args, g.recv+"."+field.name)
+	}
+	star := ""
+	if g.pointer {
+		star = "*"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "// String returns %s with the values of its fields.\n", g.recv)
+	fmt.Fprintf(&b, "func (%s %s%s) String() string {\n", g.recv, star, g.ts.Name.Name)
+	if len(args) == 0 {
+		fmt.Fprintf(&b, "\treturn %q\n}\n", g.ts.Name.Name+"{}")
+	} else {
+		format := strconv.Quote(g.ts.Name.Name + "{" + strings.Join(verbs, ", ") + "}")
+		fmt.Fprintf(&b, "\treturn fmt.Sprintf(%s, %s)\n}\n", format, strings.Join(args, ", "))
+	}
+	return b.String(), nil
+}
+
+// validate generates the checks for the rules required, min, max and len of
+// validate tags, as github.com/go-playground/validator defines them, and a
+// TODO comment for any other rule, or for a bound the field type cannot
+// hold. Strings are measured in runes, as the validator does.
+func (g *generator) validate() (string, error) {
+	if err := g.method("Validate"); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Validate checks the fields of %s against their validate tags.\n", g.recv)
+	fmt.Fprintf(&b, "func (%s *%s) Validate() error {\n", g.recv, g.ts.Name.Name)
+	checked := false
+	for _, field := range g.fields {
+		value := g.recv + "." + field.name
+		kind := valueKind(field.typ)
+		omitempty := false
+		for _, rule := range field.rules {
+			if rule == "omitempty" {
+				omitempty = true
+			}
+		}
+		for _, rule := range field.rules {
+			checked = true
+			name, arg := rule, ""
+			if i := strings.Index(rule, "="); i >= 0 {
+				name, arg = rule[:i], rule[i+1:]
+			}
+			var cond, msg string
+			switch {
+			case rule == "omitempty":
+				continue
+			case rule == "required" && kind != "other":
+				cond, msg = zeroCheck(value, kind, true), field.name+" is required"
+			case (name == "min" || name == "max" || name == "len") && fitsBound(field.typ, kind, arg):
+				subject, bound := value, arg
+				switch kind {
+				case "string":
+					subject = "utf8.RuneCountInString(" + value + ")"
+				case "len":
+					subject = "len(" + value + ")"
+				}
+				switch name {
+				case "min":
+					cond, bound = subject+" < "+arg, "at least "+arg
+				case "max":
+					cond, bound = subject+" > "+arg, "at most "+arg
+				default:
+					cond = subject + " != " + arg
+				}
+				if kind == "number" {
+					msg = field.name + " must be " + bound
+				} else {
+					msg = field.name + " must have a length of " + bound
+				}
+				if omitempty {
+					cond = zeroCheck(value, kind, false) + " && " + cond
+				}
+			default:
+				fmt.Fprintf(&b, "\t// TODO: check %s against %q.\n", field.name, rule)
+				continue
+			}
+			fmt.Fprintf(&b, "\tif %s {\n\t\treturn errors.New(%q)\n\t}\n", cond, msg)
+		}
+	}
+	if !checked {
+		fmt.Fprintf(&b, "\t// TODO: check the fields of %s.\n", g.recv)
+	}
+	b.WriteString("\treturn nil\n}\n")
+	return b.String(), nil
+}
+
+// valueKind classifies a field type for the generated code: "string",
+// "number", "nil" for types compared to nil, "len" for slices and maps, and
+// "other" for types, like bool, named types or structs, that the generators
+// cannot tell how to check.
+func valueKind(typ ast.Expr) string {
+	switch typ := typ.(type) {
+	case *ast.Ident:
+		switch typ.Name {
+		case "string":
+			return "string"
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64",
+			"uintptr", "byte", "rune", "float32", "float64":
+			return "number"
+		case "error", "any":
+			return "nil"
+		}
+	case *ast.StarExpr, *ast.InterfaceType, *ast.FuncType, *ast.ChanType:
+		return "nil"
+	case *ast.MapType:
+		return "len"
+	case *ast.ArrayType:
+		if typ.Len == nil {
+			return "len"
+		}
+	}
+	return "other"
+}
+
+// zeroCheck is the condition that value, of the given kind, is its zero
+// value, or is not if zero is false.
+func zeroCheck(value, kind string, zero bool) string {
+	eq := " == "
+	if !zero {
+		eq = " != "
+	}
+	switch kind {
+	case "string":
+		return value + eq + `""`
+	case "number":
+		return value + eq + "0"
+	case "nil":
+		return value + eq + "nil"
+	default: // len
+		return "len(" + value + ")" + eq + "0"
+	}
+}
+
+// fitsBound reports whether arg, the argument of a min, max or len rule, is
+// a constant the generated code can compare the field with: a value of its
+// number type, or a length for strings, slices and maps.
+func fitsBound(typ ast.Expr, kind, arg string) bool {
+	switch kind {
+	case "string", "len":
+		n, err := strconv.ParseInt(arg, 10, 0)
+		return err == nil && n >= 0
+	case "number":
+	default:
+		return false
+	}
+	var err error
+	switch name := typ.(*ast.Ident).Name; name {
+	case "int", "int64":
+		_, err = strconv.ParseInt(arg, 10, 64)
+	case "int8", "int16", "int32":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(name, "int"))
+		_, err = strconv.ParseInt(arg, 10, bits)
+	case "rune":
+		_, err = strconv.ParseInt(arg, 10, 32)
+	case "uint", "uint64", "uintptr":
+		_, err = strconv.ParseUint(arg, 10, 64)
+	case "uint8", "uint16", "uint32":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(name, "uint"))
+		_, err = strconv.ParseUint(arg, 10, bits)
+	case "byte":
+		_, err = strconv.ParseUint(arg, 10, 8)
+	default: // float32, float64
+		bits, _ := strconv.Atoi(strings.TrimPrefix(name, "float"))
+		var f float64
+		f, err = strconv.ParseFloat(arg, bits)
+		// ParseFloat also reads Inf and NaN, which are no Go constants.
+		if err == nil && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			return false
+		}
+	}
+	return err == nil
+}
+
+// lookupFunc reports whether the package declares a function name.
+func (p *opPackage) lookupFunc(name string) bool {
+	for _, file := range p.files {
+		for _, decl := range file.f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// paramName derives a parameter name from a field name: the name with its
+// leading capitals lower-cased, as in "url" for URL and "httpClient" for
+// HTTPClient, suffixed to avoid keywords and the names in taken, to which
+// it is added.
+func paramName(field string, taken map[string]bool) string {
+	runes := []rune(field)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	name := string(runes)
+	for token.IsKeyword(name) || taken[name] {
+		name += "_"
+	}
+	taken[name] = true
+	return name
+}
+
+// upperInitial returns name with its first letter upper-cased.
+func upperInitial(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
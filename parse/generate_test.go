@@ -0,0 +1,79 @@
+package parse
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// generateSrc declares a struct for every generator to work on and one whose
+// methods have pointer receivers.
+const generateSrc = `package p
+
+// S is checked by its tags.
+type S struct {
+	Name  string   ` + "`" + `validate:"required,min=2,max=10"` + "`" + `
+	Code  string   ` + "`" + `validate:"omitempty,len=3"` + "`" + `
+	Age   int      ` + "`" + `validate:"min=0,max=150"` + "`" + `
+	Count uint     ` + "`" + `validate:"min=-1,max=5"` + "`" + `
+	Small int8     ` + "`" + `validate:"max=300"` + "`" + `
+	Whole int      ` + "`" + `validate:"min=1.5"` + "`" + `
+	Ratio float64  ` + "`" + `validate:"min=0.5,max=Inf"` + "`" + `
+	Tags  []string ` + "`" + `validate:"min=1,dive"` + "`" + `
+	Next  *S       ` + "`" + `binding:"required"` + "`" + `
+	On    bool
+}
+
+// P has a method with a pointer receiver.
+type P struct{ n int }
+
+func (p *P) Reset() { p.n = 0 }
+`
+
+// TestGenerateGolden compares the file each generator renders with
+// testdata/generate/<name>.golden, which go test -update rewrites, and
+// checks that it builds.
+func TestGenerateGolden(t *testing.T) {
+	tests := []struct {
+		name, id, generator string
+	}{
+		{"constructor", "p.S", "constructor"},
+		{"accessors", "p.S", "accessors"},
+		{"string", "p.S", "string"},
+		{"string_pointer", "p.P", "string"},
+		{"validate", "p.S", "validate"},
+		{"all", "p.S", ""},
+	}
+	for _, test := range tests {
+		dir, pkgs := writeModule(t, map[string]string{"go.mod": "module m\n\ngo 1.21\n", "p/p.go": generateSrc})
+		op := Op{Op: "generate", ID: test.id}
+		if test.generator != "" {
+			op.Generators = []string{test.generator}
+		}
+		edits, _, err := RenderOp(context.Background(), pkgs, op)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := applyEdits(t, dir, edits)["p/p.go"]
+
+		golden := filepath.Join("testdata", "generate", test.name+".golden")
+		if *update {
+			if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
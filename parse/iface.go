@@ -0,0 +1,430 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// RenderImplement computes the edits that make a struct, given by its entity
+// ID, implement an interface: every method of the interface that the
+// pointer to the struct lacks is appended to the file of the struct, with
+// the signature the interface gives it and a body that panics. The interface
+// is an entity ID of the diagram or, for packages outside it, the import
+// path and name, as in "io.Reader"; it must be in the import graph of the
+// diagram. Methods the struct has with another signature, and fields named
+// like a method, are refused.
+func RenderImplement(ctx context.Context, pkgs map[string]*ast.Package, id, iface string) ([]FileEdit, error) {
+	parts, err := splitID(pkgs, id, 2)
+	if err != nil {
+		return nil, err
+	}
+	tp, home, err := loadTyped(ctx, pkgs, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	obj, err := lookupEntity(home.Types, parts)
+	if err != nil {
+		return nil, err
+	}
+	named, err := nonGeneric(obj.(*types.TypeName))
+	if err != nil {
+		return nil, err
+	}
+	itn, it, err := tp.lookupInterface(pkgs, iface)
+	if err != nil {
+		return nil, err
+	}
+	if itn.Pkg().Path() != home.PkgPath && !itn.Exported() {
+		return nil, fmt.Errorf("interface %s is not exported", iface)
+	}
+	ifaceName := itn.Name()
+	if itn.Pkg().Path() != home.PkgPath {
+		ifaceName = itn.Pkg().Name() + "." + ifaceName
+	}
+
+	fname, f := tp.declFile(home, obj)
+	recv := receiverField(obj.Name(), methodDecls(f, obj.Name())).Names[0].Name
+	change := &fileChange{imports: map[string]string{}}
+	q := importQualifier(f, home.PkgPath, change.imports)
+	for i := 0; i < it.NumMethods(); i++ {
+		m := it.Method(i)
+		switch have, _, _ := types.LookupFieldOrMethod(types.NewPointer(named), false, m.Pkg(), m.Name()); have := have.(type) {
+		case *types.Func:
+			if !types.Identical(have.Type(), m.Type()) {
+				return nil, fmt.Errorf("struct %s has a method %s%s, but %s wants %s%s", obj.Name(), m.Name(),
+					signatureText(have.Type().(*types.Signature), "", q), ifaceName, m.Name(), signatureText(m.Type().(*types.Signature), "", q))
+			}
+			continue
+		case *types.Var:
+			return nil, fmt.Errorf("struct %s has a field %s, which %s needs as a method", obj.Name(), m.Name(), ifaceName)
+		}
+		if !m.Exported() && m.Pkg().Path() != home.PkgPath {
+			return nil, fmt.Errorf("method %s of %s is not exported, so only package %s can implement it", m.Name(), ifaceName, m.Pkg().Name())
+		}
+		change.decls = append(change.decls, fmt.Sprintf("// %s implements %s.\nfunc (%s *%s) %s%s {\n\tpanic(\"not implemented\")\n}\n",
+			m.Name(), ifaceName, recv, obj.Name(), m.Name(), signatureText(m.Type().(*types.Signature), recv, q)))
+	}
+	if len(change.decls) == 0 {
+		return nil, nil
+	}
+	return renderChanges(pkgs, map[string]*fileChange{fname: change})
+}
+
+// RenderExtractInterface computes the edits that declare an interface name,
+// made of the given methods of a struct, at the end of the file of the
+// struct. The methods may be promoted from embedded fields. If replace is
+// set, the parameters of functions and methods in the diagram and its tests
+// that have the struct, or a pointer to it, as their type and only call
+// methods of the interface on it become of the interface type. Parameters
+// of the struct's own methods are left alone, as the interface is made of
+// their signatures.
+func RenderExtractInterface(ctx context.Context, pkgs map[string]*ast.Package, id, name string, methods []string, replace bool) ([]FileEdit, string, error) {
+	parts, err := splitID(pkgs, id, 2)
+	if err != nil {
+		return nil, "", err
+	}
+	if !token.IsIdentifier(name) {
+		return nil, "", fmt.Errorf("invalid name %q", name)
+	}
+	if len(methods) == 0 {
+		return nil, "", fmt.Errorf("no methods to extract")
+	}
+	tp, home, err := loadTyped(ctx, pkgs, parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	obj, err := lookupEntity(home.Types, parts)
+	if err != nil {
+		return nil, "", err
+	}
+	tn := obj.(*types.TypeName)
+	named, err := nonGeneric(tn)
+	if err != nil {
+		return nil, "", err
+	}
+	if home.Types.Scope().Lookup(name) != nil {
+		return nil, "", fmt.Errorf("package %s already declares %s", home.Name, name)
+	}
+
+	fname, f := tp.declFile(home, tn)
+	changes := map[string]*fileChange{fname: {imports: map[string]string{}}}
+	q := importQualifier(f, home.PkgPath, changes[fname].imports)
+	// The struct itself implements the interface only if none of the
+	// methods has a pointer receiver.
+	values, pointers := types.NewMethodSet(named), types.NewMethodSet(types.NewPointer(named))
+	byValue := true
+	chosen := map[string]bool{}
+	var b strings.Builder
+	for _, method := range methods {
+		if chosen[method] {
+			continue
+		}
+		chosen[method] = true
+		sel := pointers.Lookup(home.Types, method)
+		if sel == nil {
+			return nil, "", fmt.Errorf("struct %s has no method %s", tn.Name(), method)
+		}
+		m := sel.Obj().(*types.Func)
+		if values.Lookup(home.Types, method) == nil {
+			byValue = false
+		}
+		fmt.Fprintf(&b, "\t%s%s\n", method, signatureText(m.Type().(*types.Signature), "", q))
+	}
+	implementer := tn.Name()
+	if !byValue {
+		implementer = "*" + implementer
+	}
+	changes[fname].decls = []string{fmt.Sprintf("// %s is implemented by %s.\ntype %s interface {\n%s}\n", name, implementer, name, b.String())}
+
+	if replace {
+		key := func(obj types.Object) token.Position {
+			return tp.fset.Position(obj.Pos())
+		}
+		target := key(tn)
+		done := map[token.Position]bool{}
+		for _, pkg := range tp.loaded {
+			if pkg.TypesInfo == nil || (pkg.PkgPath != home.PkgPath && !token.IsExported(name)) {
+				continue
+			}
+			for _, file := range pkg.Syntax {
+				if !tp.files[tp.fset.Position(file.Pos()).Filename] {
+					continue
+				}
+				for _, decl := range file.Decls {
+					fn, ok := decl.(*ast.FuncDecl)
+					if !ok || fn.Body == nil || (fn.Recv != nil && len(fn.Recv.List) == 1 && typeNameOf(pkg.TypesInfo, fn.Recv.List[0].Type, key) == target) {
+						continue
+					}
+					for _, field := range fn.Type.Params.List {
+						typ, star := field.Type, false
+						if ptr, ok := typ.(*ast.StarExpr); ok {
+							typ, star = ptr.X, true
+						}
+						if typeNameOf(pkg.TypesInfo, typ, key) != target || !star && !byValue || !onlyCalls(pkg.TypesInfo, fn.Body, field.Names, chosen) {
+							continue
+						}
+						pos := tp.fset.Position(field.Type.Pos())
+						if done[pos] {
+							continue
+						}
+						done[pos] = true
+						text := name
+						if sel, ok := typ.(*ast.SelectorExpr); ok {
+							text = types.ExprString(sel.X) + "." + name
+						}
+						if changes[pos.Filename] == nil {
+							changes[pos.Filename] = &fileChange{}
+						}
+						changes[pos.Filename].spans = append(changes[pos.Filename].spans, span{pos.Offset, tp.fset.Position(field.Type.End()).Offset, text})
+					}
+				}
+			}
+		}
+	}
+
+	edits, err := renderChanges(pkgs, changes)
+	if err != nil {
+		return nil, "", err
+	}
+	return edits, EntityID(parts[0], name), nil
+}
+
+// nonGeneric returns the named type of a struct, refusing generic ones.
+func nonGeneric(tn *types.TypeName) (*types.Named, error) {
+	named, ok := tn.Type().(*types.Named)
+	if !ok || named.TypeParams().Len() > 0 {
+		return nil, fmt.Errorf("struct %s is generic, which is not supported", tn.Name())
+	}
+	return named, nil
+}
+
+// lookupInterface finds an interface by its entity ID, the ID of a package of
+// pkgs and its name, or by the import path of its package and its name.
+func (tp *typedPackages) lookupInterface(pkgs map[string]*ast.Package, id string) (*types.TypeName, *types.Interface, error) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return nil, nil, fmt.Errorf("invalid interface %q", id)
+	}
+	qual, name := id[:i], id[i+1:]
+	var found *types.Package
+	if astpkg, ok := pkgs[qual]; ok {
+		if pkg := tp.typedPackage(astpkg); pkg != nil {
+			found = pkg.Types
+		}
+	}
+	if found == nil {
+		packages.Visit(tp.loaded, nil, func(pkg *packages.Package) {
+			if pkg.PkgPath == qual && pkg.Types != nil {
+				found = pkg.Types
+			}
+		})
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("package %s is neither in the diagram nor imported by it", qual)
+	}
+	tn, ok := found.Scope().Lookup(name).(*types.TypeName)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown interface %s", id)
+	}
+	it, ok := tn.Type().Underlying().(*types.Interface)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not an interface", id)
+	}
+	if named, ok := tn.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+		return nil, nil, fmt.Errorf("interface %s is generic, which is not supported", id)
+	}
+	return tn, it, nil
+}
+
+// declFile returns the name and syntax of the file of pkg that declares obj.
+func (tp *typedPackages) declFile(pkg *packages.Package, obj types.Object) (string, *ast.File) {
+	fname := tp.fset.Position(obj.Pos()).Filename
+	for _, f := range pkg.Syntax {
+		if tp.fset.Position(f.Pos()).Filename == fname {
+			return fname, f
+		}
+	}
+	return fname, nil
+}
+
+// typeNameOf returns where the type name expr refers to is declared.
+func typeNameOf(info *types.Info, expr ast.Expr, key func(types.Object) token.Position) token.Position {
+	if ptr, ok := expr.(*ast.StarExpr); ok {
+		expr = ptr.X
+	}
+	if sel, ok := expr.(*ast.SelectorExpr); ok {
+		expr = sel.Sel
+	}
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return token.Position{}
+	}
+	tn, ok := info.Uses[ident].(*types.TypeName)
+	if !ok {
+		return token.Position{}
+	}
+	return key(tn)
+}
+
+// onlyCalls reports whether the parameters names are used in body, and only
+// to call or take the value of the methods in chosen.
+func onlyCalls(info *types.Info, body *ast.BlockStmt, names []*ast.Ident, chosen map[string]bool) bool {
+	params := map[types.Object]bool{}
+	for _, ident := range names {
+		if obj := info.Defs[ident]; obj != nil {
+			params[obj] = true
+		}
+	}
+	if len(params) == 0 {
+		return false
+	}
+	allowed := map[*ast.Ident]bool{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && params[info.Uses[x]] && chosen[sel.Sel.Name] {
+				if s := info.Selections[sel]; s != nil && s.Kind() == types.MethodVal {
+					allowed[x] = true
+				}
+			}
+		}
+		return true
+	})
+	used, ok := false, true
+	ast.Inspect(body, func(n ast.Node) bool {
+		if ident, isIdent := n.(*ast.Ident); isIdent && params[info.Uses[ident]] {
+			used = true
+			ok = ok && allowed[ident]
+		}
+		return ok
+	})
+	return used && ok
+}
+
+// signatureText formats sig as in a method declaration, without the func
+// keyword. Parameters named like the receiver recv get a trailing
+// underscore.
+func signatureText(sig *types.Signature, recv string, q types.Qualifier) string {
+	tuple := func(t *types.Tuple, variadic bool) string {
+		list := make([]string, t.Len())
+		for i := range list {
+			v := t.At(i)
+			typ := types.TypeString(v.Type(), q)
+			if variadic && i == t.Len()-1 {
+				typ = "..." + types.TypeString(v.Type().(*types.Slice).Elem(), q)
+			}
+			name := v.Name()
+			if name != "" && name == recv {
+				name += "_"
+			}
+			if name != "" {
+				typ = name + " " + typ
+			}
+			list[i] = typ
+		}
+		return strings.Join(list, ", ")
+	}
+	text := "(" + tuple(sig.Params(), sig.Variadic()) + ")"
+	switch results := sig.Results(); {
+	case results.Len() == 1 && results.At(0).Name() == "":
+		text += " " + tuple(results, false)
+	case results.Len() > 0:
+		text += " (" + tuple(results, false) + ")"
+	}
+	return text
+}
+
+// importQualifier qualifies the packages other than the one at home with
+// the name f imports them by, recording those f must import in imports.
+func importQualifier(f *ast.File, home string, imports map[string]string) types.Qualifier {
+	return func(pkg *types.Package) string {
+		if pkg.Path() == home {
+			return ""
+		}
+		if f != nil {
+			for _, spec := range f.Imports {
+				if p, err := strconv.Unquote(spec.Path.Value); err != nil || p != pkg.Path() {
+					continue
+				}
+				switch {
+				case spec.Name == nil:
+					return pkg.Name()
+				case spec.Name.Name == ".":
+					return ""
+				case spec.Name.Name != "_":
+					return spec.Name.Name
+				}
+			}
+		}
+		imports[pkg.Path()] = ""
+		return pkg.Name()
+	}
+}
+
+// fileChange is an edit of one file: spans to apply, declarations to
+// append and imports to add, by path, with their name if it is not the
+// package name.
+type fileChange struct {
+	spans   []span
+	decls   []string
+	imports map[string]string
+}
+
+// renderChanges applies changes, by absolute file name, to the files on
+// disk.
+func renderChanges(pkgs map[string]*ast.Package, changes map[string]*fileChange) ([]FileEdit, error) {
+	names := make([]string, 0, len(changes))
+	for fname := range changes {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+	var edits []FileEdit
+	for _, fname := range names {
+		change := changes[fname]
+		old, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		src, err := applySpans(old, change.spans, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error editing %s: %w", fname, err)
+		}
+		for _, decl := range change.decls {
+			src = append(append(src, '\n'), decl...)
+		}
+
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fname, src, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("error editing %s: %w", fname, err)
+		}
+		paths := make([]string, 0, len(change.imports))
+		for importPath := range change.imports {
+			paths = append(paths, importPath)
+		}
+		sort.Strings(paths)
+		for _, importPath := range paths {
+			astutil.AddNamedImport(fset, f, change.imports[importPath], importPath)
+		}
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, f); err != nil {
+			return nil, fmt.Errorf("error formatting %s: %w", fname, err)
+		}
+		if !bytes.Equal(old, buf.Bytes()) {
+			edits = append(edits, FileEdit{Name: modelName(pkgs, fname), Old: old, New: buf.Bytes()})
+		}
+	}
+	return edits, nil
+}
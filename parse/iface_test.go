@@ -0,0 +1,221 @@
+package parse
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// ifaceModule declares interfaces and structs in package p, with functions
+// taking a *Buf in p and q.
+var ifaceModule = map[string]string{
+	"go.mod": "module m\n\ngo 1.21\n",
+	"p/p.go": `package p
+
+import (
+	"io"
+	"strings"
+)
+
+// Sink writes somewhere.
+type Sink interface {
+	Write(p []byte) (int, error)
+	Flush() error
+}
+
+// Copier names its parameters like the packages of their types.
+type Copier interface {
+	CopyFrom(io io.Reader, strings []strings.Builder) (n int64, err error)
+}
+
+// Buf is a buffer.
+type Buf struct{ data []byte }
+
+func (b *Buf) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func (b *Buf) Len() int { return len(b.data) }
+
+func (b *Buf) Drain(io io.Reader) error { return nil }
+
+// Bad has a Flush of another signature.
+type Bad struct{}
+
+func (b Bad) Flush() {}
+
+// Field has a field named like a method of Sink.
+type Field struct{ Flush int }
+
+func (f *Field) Write(p []byte) (int, error) { return 0, nil }
+
+func Fill(b *Buf) { b.Write(nil) }
+
+func Size(b *Buf) int { return b.Len() }
+
+func Keep(b *Buf) *Buf {
+	b.Write(nil)
+	return b
+}
+
+func Peek(b *Buf) int {
+	b.Write(nil)
+	return len(b.data)
+}
+`,
+	"q/q.go": `package q
+
+import "m/p"
+
+// Q is empty.
+type Q struct{}
+
+func Use(b *p.Buf) { b.Write(nil) }
+`,
+}
+
+// checkContains reports the texts in want that content lacks, or has if
+// prefixed with "!".
+func checkContains(t *testing.T, what, content string, want []string) {
+	t.Helper()
+	for _, w := range want {
+		if text, ok := strings.CutPrefix(w, "!"); ok {
+			if strings.Contains(content, text) {
+				t.Errorf("%s: still has %q:\n%s", what, text, content)
+			}
+		} else if !strings.Contains(content, w) {
+			t.Errorf("%s: lacks %q:\n%s", what, w, content)
+		}
+	}
+}
+
+func TestRenderImplement(t *testing.T) {
+	tests := []struct {
+		id, iface string
+		want      map[string][]string
+	}{
+		{
+			// Only the missing method is added.
+			id:    "p.Buf",
+			iface: "p.Sink",
+			want: map[string][]string{"p/p.go": {
+				"// Flush implements Sink.\nfunc (b *Buf) Flush() error {\n\tpanic(\"not implemented\")\n}",
+				"!// Write implements",
+			}},
+		},
+		{
+			id:    "p.Buf",
+			iface: "p.Copier",
+			want: map[string][]string{"p/p.go": {
+				"func (b *Buf) CopyFrom(io io.Reader, strings []strings.Builder) (n int64, err error) {",
+			}},
+		},
+		{
+			// The file of Q gets the imports of the signature.
+			id:    "q.Q",
+			iface: "p.Copier",
+			want: map[string][]string{"q/q.go": {
+				"\"io\"\n", "\"strings\"\n",
+				"// CopyFrom implements p.Copier.\nfunc (q *Q) CopyFrom(io io.Reader, strings []strings.Builder) (n int64, err error) {",
+			}},
+		},
+		{
+			id:    "q.Q",
+			iface: "io.Writer",
+			want: map[string][]string{"q/q.go": {
+				"// Write implements io.Writer.\nfunc (q *Q) Write(p []byte) (n int, err error) {",
+			}},
+		},
+	}
+	for _, test := range tests {
+		dir, pkgs := writeModule(t, ifaceModule)
+		edits, err := RenderImplement(context.Background(), pkgs, test.id, test.iface)
+		if err != nil {
+			t.Errorf("implement %s by %s: %v", test.iface, test.id, err)
+			continue
+		}
+		got := applyEdits(t, dir, edits)
+		if len(got) != len(test.want) {
+			t.Errorf("implement %s by %s: edited %d files, want %d", test.iface, test.id, len(got), len(test.want))
+		}
+		for file, want := range test.want {
+			checkContains(t, "implement "+test.iface+" by "+test.id+": "+file, got[file], want)
+		}
+	}
+}
+
+func TestRenderImplementRefused(t *testing.T) {
+	_, pkgs := writeModule(t, ifaceModule)
+	tests := []struct {
+		id, iface, want string
+	}{
+		{"p.Bad", "p.Sink", "struct Bad has a method Flush(), but Sink wants Flush() error"},
+		{"p.Field", "p.Sink", "struct Field has a field Flush, which Sink needs as a method"},
+		{"q.Q", "p.Buf", "p.Buf is not an interface"},
+		{"q.Q", "p.Nope", "unknown interface p.Nope"},
+		{"q.Q", "net/http.Handler", "package net/http is neither in the diagram nor imported by it"},
+	}
+	for _, test := range tests {
+		_, err := RenderImplement(context.Background(), pkgs, test.id, test.iface)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("implement %s by %s: got %v, want %q", test.iface, test.id, err, test.want)
+		}
+	}
+
+	// Nothing is missing.
+	if edits, err := RenderImplement(context.Background(), pkgs, "p.Buf", "io.Writer"); err != nil || len(edits) != 0 {
+		t.Errorf("implement io.Writer by p.Buf: %v, %v", edits, err)
+	}
+}
+
+func TestRenderExtractInterface(t *testing.T) {
+	dir, pkgs := writeModule(t, ifaceModule)
+	edits, id, err := RenderExtractInterface(context.Background(), pkgs, "p.Buf", "Writer", []string{"Write", "Drain"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "p.Writer" {
+		t.Errorf("id %q, want p.Writer", id)
+	}
+	got := applyEdits(t, dir, edits)
+	checkContains(t, "p/p.go", got["p/p.go"], []string{
+		"// Writer is implemented by *Buf.\ntype Writer interface {\n\tWrite(p []byte) (int, error)\n\tDrain(io io.Reader) error\n}",
+		// Only Fill calls nothing but methods of Writer on b.
+		"func Fill(b Writer) {",
+		"func Size(b *Buf) int {",
+		"func Keep(b *Buf) *Buf {",
+		"func Peek(b *Buf) int {",
+		// The methods of Buf keep their receiver.
+		"func (b *Buf) Write(p []byte)",
+	})
+	checkContains(t, "q/q.go", got["q/q.go"], []string{"func Use(b p.Writer) {"})
+
+	// Without replace only the interface is added.
+	dir, pkgs = writeModule(t, ifaceModule)
+	edits, _, err = RenderExtractInterface(context.Background(), pkgs, "p.Buf", "Writer", []string{"Write"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = applyEdits(t, dir, edits)
+	if len(got) != 1 {
+		t.Errorf("edited %d files without replace, want 1", len(got))
+	}
+	checkContains(t, "p/p.go without replace", got["p/p.go"], []string{"type Writer interface", "func Fill(b *Buf) {"})
+
+	for _, test := range []struct {
+		name    string
+		methods []string
+		want    string
+	}{
+		{"Sink", []string{"Write"}, "package p already declares Sink"},
+		{"W", []string{"Missing"}, "struct Buf has no method Missing"},
+		{"W", nil, "no methods to extract"},
+		{"1W", []string{"Write"}, `invalid name "1W"`},
+	} {
+		_, _, err := RenderExtractInterface(context.Background(), pkgs, "p.Buf", test.name, test.methods, false)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("extract %s%v: got %v, want %q", test.name, test.methods, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+// fixImports adds the imports src needs and removes those it no longer
+// uses, as goimports does. goimports falls back on any package in the module
+// cache; an import it adds that the module graph of the file does not
+// provide is dropped again, so that the type check reports the undefined
+// name instead of the edit depending on a module that is not required.
+func fixImports(name string, src []byte) ([]byte, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	fixed, err := imports.Process(abs, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fixing imports of %s: %w", name, err)
+	}
+
+	added, err := addedImports(src, fixed)
+	if err != nil || len(added) == 0 {
+		return fixed, err
+	}
+	unresolved, err := unresolvedImports(filepath.Dir(abs), added)
+	if err != nil || len(unresolved) == 0 {
+		return fixed, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, abs, fixed, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for _, importPath := range unresolved {
+		astutil.DeleteImport(fset, f, importPath)
+	}
+	ungroupImport(f)
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, fmt.Errorf("error formatting %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// addedImports returns the import paths of fixed that src does not import.
+func addedImports(src, fixed []byte) ([]string, error) {
+	before, err := importPaths(src)
+	if err != nil {
+		return nil, err
+	}
+	after, err := importPaths(fixed)
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for _, importPath := range sortedKeys(after) {
+		if !before[importPath] {
+			added = append(added, importPath)
+		}
+	}
+	return added, nil
+}
+
+func importPaths(src []byte) (map[string]bool, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for _, spec := range f.Imports {
+		if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+			paths[importPath] = true
+		}
+	}
+	return paths, nil
+}
+
+// unresolvedImports returns the import paths that neither the standard
+// library nor the modules required by the module of dir provide. Nothing is
+// downloaded to find out. The directory may be yet to be created.
+func unresolvedImports(dir string, importPaths []string) ([]string, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName,
+		Dir:  existingDir(dir),
+		Env:  append(os.Environ(), "GOPROXY=off"),
+	}
+	pkgs, err := packages.Load(cfg, importPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving imports: %w", err)
+	}
+	resolved := map[string]bool{}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) == 0 {
+			resolved[pkg.PkgPath] = true
+		}
+	}
+	var unresolved []string
+	for _, importPath := range importPaths {
+		if !resolved[importPath] {
+			unresolved = append(unresolved, importPath)
+		}
+	}
+	return unresolved, nil
+}
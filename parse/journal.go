@@ -0,0 +1,201 @@
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrNothingToUndo = errors.New("nothing to undo")
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// ConflictError reports a file whose content on disk is not what an edit
+// expects, because it was changed outside the journal. Version is set when
+// the edit was made against an older version of the file: it is the current
+// one. Removed is set instead when that file no longer exists.
+type ConflictError struct {
+	File    string
+	Version string
+	Removed bool
+}
+
+func (e *ConflictError) Error() string {
+	switch {
+	case e.Removed:
+		return fmt.Sprintf("%s has been removed since the diagram was loaded", e.File)
+	case e.Version != "":
+		return fmt.Sprintf("%s has changed on disk since the diagram was loaded", e.File)
+	}
+	return fmt.Sprintf("%s has changed on disk since the edit", e.File)
+}
+
+// Journal applies edits and keeps the content of every file before and
+// after each of them, so that they can be undone and redone. It holds at
+// most limit edits; older ones can no longer be undone.
+type Journal struct {
+	mu     sync.Mutex
+	limit  int
+	done   [][]FileEdit
+	undone [][]FileEdit
+}
+
+// NewJournal returns an empty journal holding up to limit edits.
+func NewJournal(limit int) *Journal {
+	return &Journal{limit: limit}
+}
+
+// Apply writes the edits, which must all start from the current content of
+// their files, and records them. An applied edit clears the redo history.
+func (j *Journal) Apply(edits []FileEdit) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := writeEdits(edits, false); err != nil {
+		return err
+	}
+	j.done = append(j.done, edits)
+	if len(j.done) > j.limit {
+		j.done = j.done[len(j.done)-j.limit:]
+	}
+	j.undone = nil
+	return nil
+}
+
+// Undo restores the files of the last applied edit and returns it. It is
+// refused with a ConflictError if any of them changed since.
+func (j *Journal) Undo() ([]FileEdit, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.done) == 0 {
+		return nil, ErrNothingToUndo
+	}
+	edits := j.done[len(j.done)-1]
+	if err := writeEdits(edits, true); err != nil {
+		return nil, err
+	}
+	j.done = j.done[:len(j.done)-1]
+	j.undone = append(j.undone, edits)
+	return edits, nil
+}
+
+// Redo applies the last undone edit again and returns it. It is refused
+// with a ConflictError if any of its files changed since the undo.
+func (j *Journal) Redo() ([]FileEdit, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.undone) == 0 {
+		return nil, ErrNothingToRedo
+	}
+	edits := j.undone[len(j.undone)-1]
+	if err := writeEdits(edits, false); err != nil {
+		return nil, err
+	}
+	j.undone = j.undone[:len(j.undone)-1]
+	j.done = append(j.done, edits)
+	return edits, nil
+}
+
+// writeEdits moves every file from Old to New, or back when reverse is
+// set. A nil content stands for a missing file: the edit creates it, with
+// its directory, and reversing it removes both again if they are left
+// empty. All files are checked before any is written, and the files already
+// written are restored if a later one fails.
+func writeEdits(edits []FileEdit, reverse bool) error {
+	from := func(e FileEdit) []byte {
+		if reverse {
+			return e.New
+		}
+		return e.Old
+	}
+	to := func(e FileEdit) []byte {
+		if reverse {
+			return e.Old
+		}
+		return e.New
+	}
+
+	for _, edit := range edits {
+		current, err := os.ReadFile(edit.Name)
+		if errors.Is(err, fs.ErrNotExist) && from(edit) == nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if from(edit) == nil || !bytes.Equal(current, from(edit)) {
+			return &ConflictError{File: edit.Name}
+		}
+	}
+
+	for i, edit := range edits {
+		if err := writeContent(edit.Name, to(edit)); err != nil {
+			for _, written := range edits[:i] {
+				writeContent(written.Name, from(written))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// writeContent writes data to name, or removes name when data is nil.
+func writeContent(name string, data []byte) error {
+	if data == nil {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		// Only succeeds if the file was the last one in its directory.
+		os.Remove(filepath.Dir(name))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return writeFileAtomic(name, data)
+}
+
+// writeFileAtomic replaces name with data through a temporary file in the
+// same directory, so that a crash leaves either the old or the new content
+// and never a truncated file. The file keeps its permissions.
+func writeFileAtomic(name string, data []byte) error {
+	perm := fs.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	return nil
+}
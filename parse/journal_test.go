@@ -0,0 +1,197 @@
+package parse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkFiles compares the files below dir, by slash-separated name, with
+// want; a nil content stands for a missing file.
+func checkFiles(t *testing.T, what, dir string, want map[string][]byte) {
+	t.Helper()
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		switch {
+		case content == nil && !errors.Is(err, os.ErrNotExist):
+			t.Errorf("%s: %s exists", what, name)
+		case content == nil:
+		case err != nil:
+			t.Errorf("%s: %v", what, err)
+		case string(got) != string(content):
+			t.Errorf("%s: %s = %q, want %q", what, name, got, content)
+		}
+	}
+}
+
+func TestJournalUndoRedo(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "sub", "b.go")
+	if err := os.WriteFile(a, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJournal(10)
+	if _, err := j.Undo(); err != ErrNothingToUndo {
+		t.Errorf("Undo of an empty journal: %v", err)
+	}
+	if err := j.Apply([]FileEdit{
+		{Name: a, Old: []byte("v1"), New: []byte("v2")},
+		{Name: b, New: []byte("new")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, "apply", dir, map[string][]byte{"a.go": []byte("v2"), "sub/b.go": []byte("new")})
+
+	// Undo removes the created file along with its directory.
+	if _, err := j.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, "undo", dir, map[string][]byte{"a.go": []byte("v1"), "sub/b.go": nil, "sub": nil})
+	if _, err := j.Redo(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, "redo", dir, map[string][]byte{"a.go": []byte("v2"), "sub/b.go": []byte("new")})
+	if _, err := j.Redo(); err != ErrNothingToRedo {
+		t.Errorf("second Redo: %v", err)
+	}
+
+	// A new edit clears the redo history.
+	if _, err := j.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Apply([]FileEdit{{Name: a, Old: []byte("v1"), New: []byte("v3")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Redo(); err != ErrNothingToRedo {
+		t.Errorf("Redo after Apply: %v", err)
+	}
+}
+
+func TestJournalConflicts(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(a, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJournal(10)
+	var conflict *ConflictError
+
+	// An edit of an older content is refused and writes nothing.
+	err := j.Apply([]FileEdit{{Name: a, Old: []byte("v0"), New: []byte("v2")}})
+	if !errors.As(err, &conflict) || conflict.File != a {
+		t.Errorf("Apply of a stale edit: %v", err)
+	}
+	checkFiles(t, "stale apply", dir, map[string][]byte{"a.go": []byte("v1")})
+
+	if err := j.Apply([]FileEdit{{Name: a, Old: []byte("v1"), New: []byte("v2")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(a, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Undo(); !errors.As(err, &conflict) || conflict.File != a {
+		t.Errorf("Undo after an outside change: %v", err)
+	}
+	checkFiles(t, "refused undo", dir, map[string][]byte{"a.go": []byte("outside")})
+
+	// The edit is still there to undo once the change is reverted.
+	if err := os.WriteFile(a, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(a, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Redo(); !errors.As(err, &conflict) {
+		t.Errorf("Redo after an outside change: %v", err)
+	}
+	checkFiles(t, "refused redo", dir, map[string][]byte{"a.go": []byte("outside")})
+}
+
+func TestJournalLimit(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(a, []byte("v0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJournal(2)
+	for _, v := range []string{"v1", "v2", "v3"} {
+		old, err := os.ReadFile(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Apply([]FileEdit{{Name: a, Old: old, New: []byte(v)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := j.Undo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := j.Undo(); err != ErrNothingToUndo {
+		t.Errorf("Undo past the limit: %v", err)
+	}
+	checkFiles(t, "undo to the limit", dir, map[string][]byte{"a.go": []byte("v1")})
+}
+
+func TestWriteEditsRollback(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(a, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Both new files pass the check, but once the first is written the
+	// second cannot get its directory.
+	err := writeEdits([]FileEdit{
+		{Name: a, Old: []byte("v1"), New: []byte("v2")},
+		{Name: filepath.Join(dir, "d"), New: []byte("file")},
+		{Name: filepath.Join(dir, "d", "x.go"), New: []byte("x")},
+	}, false)
+	if err == nil {
+		t.Fatal("writing under a file succeeded")
+	}
+	checkFiles(t, "rollback", dir, map[string][]byte{"a.go": []byte("v1"), "d": nil})
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
+
+func TestWriteFileAtomicKeepsPermissions(t *testing.T) {
+	dir := t.TempDir()
+	for _, perm := range []os.FileMode{0600, 0755, 0640} {
+		name := filepath.Join(dir, "f.go")
+		if err := os.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(name, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFileAtomic(name, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Errorf("mode %v after replacing a file of mode %v", info.Mode().Perm(), perm)
+		}
+		checkFiles(t, "replace", dir, map[string][]byte{"f.go": []byte("new")})
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	// A new file gets the usual mode.
+	name := filepath.Join(dir, "n.go")
+	if err := writeFileAtomic(name, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("new file: %v, %v", info, err)
+	}
+}
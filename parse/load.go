@@ -0,0 +1,53 @@
+package parse
+
+import (
+	"context"
+	"io/fs"
+	"log"
+)
+
+// Model is the diagram of a source tree: its packages, files, structs,
+// the edges between structs, and the global functions.
+type Model = ClientStruct
+
+// Options configures Load. The zero value is ready to use.
+type Options struct {
+	// FS, when set, is read instead of the operating system's file system
+	// and the directory passed to Load is a slash-separated path inside it.
+	FS fs.FS
+
+	// Workers bounds the number of files parsed at the same time. Zero means
+	// runtime.GOMAXPROCS(0).
+	Workers int
+
+	// CacheDir, when set, persists parse results between runs.
+	CacheDir string
+
+	// Logger receives progress messages. Nil discards them.
+	Logger *log.Logger
+}
+
+// Load builds the model of every package below dir. Files that do not
+// parse are left out of the model and reported as diagnostics; the error is
+// only set when the tree itself cannot be read or ctx is cancelled.
+func Load(ctx context.Context, dir string, opts Options) (*Model, []Diagnostic, error) {
+	p := NewParser()
+	p.SetWorkers(opts.Workers)
+	p.SetCacheDir(opts.CacheDir)
+	p.SetLogger(opts.Logger)
+
+	var model *Model
+	var err error
+	if opts.FS != nil {
+		if dir == "" {
+			dir = "."
+		}
+		model, _, err = p.ParseFS(ctx, opts.FS, dir)
+	} else {
+		model, _, err = p.ParseDir(ctx, dir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return model, model.Diagnostics, nil
+}
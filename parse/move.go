@@ -0,0 +1,621 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// RenderMove computes the edits that move a struct, given by its entity ID,
+// together with all its methods to the file dest, and returns the ID the
+// struct gets. The file may belong to another package and need not exist:
+// a file in a directory without Go files starts a new package, named after
+// the directory. References to the struct in the packages of pkgs and their
+// tests are qualified with its new package, or lose their qualifier inside
+// it, the moved code qualifies what it uses of the package it leaves, and
+// imports are added and removed to match. A move that would create an
+// import cycle is refused.
+func RenderMove(ctx context.Context, pkgs map[string]*ast.Package, id, dest string) ([]FileEdit, string, error) {
+	parts, err := splitID(pkgs, id, 2)
+	if err != nil {
+		return nil, "", err
+	}
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return nil, "", err
+	}
+	if filepath.Ext(dest) != ".go" || strings.HasSuffix(dest, "_test.go") {
+		return nil, "", fmt.Errorf("%s is not a Go source file", dest)
+	}
+
+	tp, src, err := loadTyped(ctx, pkgs, parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	obj, err := lookupEntity(src.Types, parts)
+	if err != nil {
+		return nil, "", err
+	}
+	tn := obj.(*types.TypeName)
+	m := &mover{
+		typedPackages: tp,
+		src:           src,
+		tn:            tn,
+		dest:          dest,
+		spans:         map[string][]span{},
+		imports:       map[string]map[string]string{},
+		unused:        map[string]map[string]bool{},
+		pkgPaths:      map[string]string{},
+	}
+	if err := m.target(diagramRoot(pkgs[parts[0]], parts[0])); err != nil {
+		return nil, "", err
+	}
+	newID := EntityID(m.dstID, tn.Name())
+	if err := m.collect(); err != nil {
+		return nil, "", err
+	}
+	if len(m.moved) == 0 {
+		return nil, newID, nil
+	}
+	if err := m.scan(); err != nil {
+		return nil, "", err
+	}
+	contents, err := m.render()
+	if err != nil {
+		return nil, "", err
+	}
+	if !m.same {
+		if cycle := m.importCycle(contents); cycle != nil {
+			return nil, "", fmt.Errorf("moving %s to package %s would create an import cycle: %s", tn.Name(), m.dstPath, strings.Join(cycle, " -> "))
+		}
+	}
+
+	names := make([]string, 0, len(contents))
+	for fname := range contents {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+	var edits []FileEdit
+	for _, fname := range names {
+		file := contents[fname]
+		if file.old != nil && bytes.Equal(file.old, file.new) {
+			continue
+		}
+		edits = append(edits, FileEdit{Name: modelName(pkgs, fname), Old: file.old, New: file.new})
+	}
+	return edits, newID, nil
+}
+
+// span replaces the source between two offsets with text.
+type span struct {
+	start, end int
+	text       string
+}
+
+// movedDecl is a declaration that moves: the type declaration or one of its
+// methods, from start to end of its file, including its comments. Its own
+// spans rewrite the moved text.
+type movedDecl struct {
+	file       string
+	start, end int
+	spans      []span
+}
+
+type mover struct {
+	*typedPackages
+	src  *packages.Package
+	tn   *types.TypeName
+	dest string
+
+	// The package the struct moves to, which may be src itself.
+	dstID, dstName, dstPath string
+	same                    bool
+
+	moved []*movedDecl
+	// spans, imports and unused are by absolute file name: the edits
+	// outside the moved declarations, the imports to add, by path, with
+	// their name if it is not the package name, and the imports that may no
+	// longer be used.
+	spans    map[string][]span
+	imports  map[string]map[string]string
+	unused   map[string]map[string]bool
+	pkgPaths map[string]string
+}
+
+// target determines the package of the destination file, which must lie
+// below root, the root of the diagram.
+func (m *mover) target(root string) error {
+	dir := filepath.Dir(m.dest)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the diagram", dir)
+	}
+	for _, pkg := range m.loaded {
+		if pkg.ID != pkg.PkgPath || len(pkg.GoFiles) == 0 || filepath.Dir(pkg.GoFiles[0]) != dir {
+			continue
+		}
+		if pkg.Types == nil {
+			return fmt.Errorf("package %s does not type-check", pkg.Name)
+		}
+		m.dstID, m.dstName, m.dstPath = PackageID(filepath.ToSlash(rel), pkg.Name), pkg.Name, pkg.PkgPath
+		m.same = pkg.PkgPath == m.src.PkgPath
+		if !m.same && pkg.Types.Scope().Lookup(m.tn.Name()) != nil {
+			return fmt.Errorf("package %s already declares %s", pkg.Name, m.tn.Name())
+		}
+		return nil
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.go")); len(matches) > 0 {
+		return fmt.Errorf("%s holds a package outside the diagram", dir)
+	}
+	mod := m.src.Module
+	if mod == nil || mod.Dir == "" {
+		return fmt.Errorf("package %s is not in a module", m.src.Name)
+	}
+	modRel, err := filepath.Rel(mod.Dir, dir)
+	if err != nil || strings.HasPrefix(filepath.ToSlash(modRel), "..") {
+		return fmt.Errorf("%s is outside module %s", dir, mod.Path)
+	}
+	m.dstName, m.dstPath = filepath.Base(dir), path.Join(mod.Path, filepath.ToSlash(modRel))
+	if !token.IsIdentifier(m.dstName) || m.dstName == "main" {
+		return fmt.Errorf("cannot name a package after directory %s", dir)
+	}
+	m.dstID = PackageID(filepath.ToSlash(rel), m.dstName)
+	return nil
+}
+
+// collect finds the declarations that move: the type declaration and its
+// methods, except those in the destination file already.
+func (m *mover) collect() error {
+	info := m.src.TypesInfo
+	for _, f := range m.src.Syntax {
+		fname := m.fset.File(f.Pos()).Name()
+		if fname == m.dest {
+			continue
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					ts, ok := spec.(*ast.TypeSpec)
+					if !ok || info.Defs[ts.Name] != m.tn {
+						continue
+					}
+					if len(decl.Specs) == 1 {
+						m.moved = append([]*movedDecl{m.movedDecl(fname, decl.Doc, decl, nil)}, m.moved...)
+						break
+					}
+					// A spec out of a group becomes a declaration of its own.
+					d := m.movedDecl(fname, ts.Doc, ts, ts.Comment)
+					d.spans = append(d.spans, span{start: m.fset.Position(ts.Pos()).Offset, end: m.fset.Position(ts.Pos()).Offset, text: "type "})
+					m.moved = append([]*movedDecl{d}, m.moved...)
+				}
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					continue
+				}
+				if fn, ok := info.Defs[decl.Name].(*types.Func); ok && receiverType(fn) == m.tn {
+					m.moved = append(m.moved, m.movedDecl(fname, decl.Doc, decl, nil))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// receiverType returns the type whose method fn is.
+func receiverType(fn *types.Func) *types.TypeName {
+	t := fn.Type().(*types.Signature).Recv().Type()
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		return named.Origin().Obj()
+	}
+	return nil
+}
+
+// movedDecl returns node, with its doc comment and the comment that follows
+// it on its last line, as a declaration to move. The text it leaves is
+// removed from its file.
+func (m *mover) movedDecl(fname string, doc *ast.CommentGroup, node ast.Node, comment *ast.CommentGroup) *movedDecl {
+	start := node.Pos()
+	if doc != nil {
+		start = doc.Pos()
+	}
+	end := node.End()
+	if comment != nil {
+		end = comment.End()
+	}
+	d := &movedDecl{file: fname, start: m.fset.Position(start).Offset, end: m.fset.Position(end).Offset}
+	if src, err := ioutil.ReadFile(fname); err == nil {
+		d.end = lineCommentEnd(src, d.end)
+	}
+	m.spans[fname] = append(m.spans[fname], span{start: d.start, end: d.end})
+	return d
+}
+
+// lineCommentEnd extends end over a line comment following it.
+func lineCommentEnd(src []byte, end int) int {
+	i := end
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+		i++
+	}
+	if !bytes.HasPrefix(src[i:], []byte("//")) {
+		return end
+	}
+	if nl := bytes.IndexByte(src[i:], '\n'); nl >= 0 {
+		return i + nl
+	}
+	return len(src)
+}
+
+// movedAt returns the moved declaration around offset in fname, if any.
+func (m *mover) movedAt(fname string, offset int) *movedDecl {
+	for _, d := range m.moved {
+		if d.file == fname && d.start <= offset && offset < d.end {
+			return d
+		}
+	}
+	return nil
+}
+
+// scan finds the references to update in every file of the diagram. Test
+// variants type-check the same files again, with objects of their own, so
+// objects are matched by where they are declared and every place is
+// rewritten once.
+func (m *mover) scan() error {
+	key := func(obj types.Object) token.Position {
+		return m.fset.Position(obj.Pos())
+	}
+	target := key(m.tn)
+	done := map[token.Position]bool{}
+	add := func(fname string, d *movedDecl, s span) {
+		pos := token.Position{Filename: fname, Offset: s.start}
+		if done[pos] {
+			return
+		}
+		done[pos] = true
+		if d != nil {
+			d.spans = append(d.spans, s)
+		} else {
+			m.spans[fname] = append(m.spans[fname], s)
+		}
+	}
+
+	for _, pkg := range m.loaded {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		info := pkg.TypesInfo
+		for _, f := range pkg.Syntax {
+			fname := m.fset.File(f.Pos()).Name()
+			if !m.files[fname] {
+				continue
+			}
+			m.pkgPaths[fname] = pkg.PkgPath
+			inDst := pkg.PkgPath == m.dstPath
+			offset := func(pos token.Pos) int {
+				return m.fset.Position(pos).Offset
+			}
+			var err error
+			ast.Inspect(f, func(n ast.Node) bool {
+				if err != nil {
+					return false
+				}
+				switch n := n.(type) {
+				case *ast.SelectorExpr:
+					x, ok := n.X.(*ast.Ident)
+					if !ok {
+						return true
+					}
+					pn, ok := info.Uses[x].(*types.PkgName)
+					if !ok {
+						return true
+					}
+					imported := pn.Imported().Path()
+					if obj := info.Uses[n.Sel]; obj != nil && key(obj) == target {
+						// A reference from another package.
+						if inDst {
+							add(fname, nil, span{start: offset(x.Pos()), end: offset(n.Sel.Pos())})
+						} else {
+							add(fname, nil, span{start: offset(x.Pos()), end: offset(x.End()), text: m.qualifier(f, fname)})
+						}
+						m.mayBeUnused(fname, imported)
+						return false
+					}
+					d := m.movedAt(fname, offset(n.Pos()))
+					if d == nil {
+						return false
+					}
+					m.mayBeUnused(fname, imported)
+					if imported == m.dstPath {
+						add(fname, d, span{start: offset(x.Pos()), end: offset(n.Sel.Pos())})
+						return false
+					}
+					name := ""
+					if pn.Name() != pn.Imported().Name() {
+						name = pn.Name()
+					}
+					m.need(m.dest, imported, name)
+					return false
+
+				case *ast.Ident:
+					obj := info.Uses[n]
+					if obj == nil || m.same {
+						return true
+					}
+					d := m.movedAt(fname, offset(n.Pos()))
+					if key(obj) == target {
+						if d == nil {
+							add(fname, nil, span{start: offset(n.Pos()), end: offset(n.Pos()), text: m.qualifier(f, fname) + "."})
+						}
+						return true
+					}
+					if d == nil || obj.Pkg() == nil || obj.Pkg().Path() != m.src.PkgPath || obj.Parent() != obj.Pkg().Scope() {
+						return true
+					}
+					if !obj.Exported() {
+						err = fmt.Errorf("%s refers to %s, which package %s does not export", m.tn.Name(), obj.Name(), m.src.Name)
+						return false
+					}
+					m.need(m.dest, m.src.PkgPath, "")
+					add(fname, d, span{start: offset(n.Pos()), end: offset(n.Pos()), text: m.src.Name + "."})
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// qualifier returns the name f refers to the destination package by, and
+// makes sure f imports it.
+func (m *mover) qualifier(f *ast.File, fname string) string {
+	for _, spec := range f.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err == nil && p == m.dstPath && spec.Name != nil && spec.Name.Name != "_" && spec.Name.Name != "." {
+			return spec.Name.Name
+		}
+	}
+	m.need(fname, m.dstPath, "")
+	return m.dstName
+}
+
+func (m *mover) need(fname, importPath, name string) {
+	if m.imports[fname] == nil {
+		m.imports[fname] = map[string]string{}
+	}
+	m.imports[fname][importPath] = name
+}
+
+func (m *mover) mayBeUnused(fname, importPath string) {
+	if m.unused[fname] == nil {
+		m.unused[fname] = map[string]bool{}
+	}
+	m.unused[fname][importPath] = true
+}
+
+// movedFile is the content of a file before and after the move, and its
+// syntax afterwards.
+type movedFile struct {
+	old, new []byte
+	f        *ast.File
+}
+
+// render applies the spans, appends the moved declarations to the
+// destination file and fixes the imports of every file it touches.
+func (m *mover) render() (map[string]*movedFile, error) {
+	names := map[string]bool{m.dest: true}
+	for fname := range m.spans {
+		names[fname] = true
+	}
+	for fname := range m.imports {
+		names[fname] = true
+	}
+
+	var moved []string
+	for _, d := range m.moved {
+		src, err := ioutil.ReadFile(d.file)
+		if err != nil {
+			return nil, err
+		}
+		text, err := applySpans(src[d.start:d.end], d.spans, d.start)
+		if err != nil {
+			return nil, fmt.Errorf("error moving code from %s: %w", d.file, err)
+		}
+		moved = append(moved, string(text))
+	}
+
+	contents := map[string]*movedFile{}
+	for fname := range names {
+		old, err := ioutil.ReadFile(fname)
+		if err != nil && !(fname == m.dest && os.IsNotExist(err)) {
+			return nil, err
+		}
+		src := old
+		if old != nil {
+			if src, err = applySpans(old, m.spans[fname], 0); err != nil {
+				return nil, fmt.Errorf("error moving code out of %s: %w", fname, err)
+			}
+		}
+		if fname == m.dest {
+			var buf bytes.Buffer
+			if old == nil {
+				fmt.Fprintf(&buf, "package %s\n", m.dstName)
+			} else {
+				buf.Write(src)
+			}
+			for _, text := range moved {
+				buf.WriteString("\n")
+				buf.WriteString(text)
+				buf.WriteString("\n")
+			}
+			src = buf.Bytes()
+		}
+
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fname, src, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("error moving %s: %w", m.tn.Name(), err)
+		}
+		own := m.pkgPaths[fname]
+		if fname == m.dest {
+			own = m.dstPath
+		}
+		// Removals go first, so that a lone import is not left in a group.
+		deleted := false
+		for _, importPath := range sortedKeys(m.unused[fname]) {
+			if astutil.UsesImport(f, importPath) {
+				continue
+			}
+			for _, spec := range f.Imports {
+				if p, err := strconv.Unquote(spec.Path.Value); err == nil && p == importPath {
+					name := ""
+					if spec.Name != nil {
+						name = spec.Name.Name
+					}
+					deleted = astutil.DeleteNamedImport(fset, f, name, importPath) || deleted
+					break
+				}
+			}
+		}
+		if deleted {
+			ungroupImport(f)
+		}
+		imports := m.imports[fname]
+		paths := make([]string, 0, len(imports))
+		for importPath := range imports {
+			paths = append(paths, importPath)
+		}
+		sort.Strings(paths)
+		for _, importPath := range paths {
+			if importPath != own {
+				astutil.AddNamedImport(fset, f, imports[importPath], importPath)
+			}
+		}
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, f); err != nil {
+			return nil, err
+		}
+		contents[fname] = &movedFile{old: old, new: buf.Bytes(), f: f}
+	}
+	return contents, nil
+}
+
+// ungroupImport drops the parentheses around the only import of f, unless
+// comments are in them.
+func ungroupImport(f *ast.File) {
+	if len(f.Decls) == 0 {
+		return
+	}
+	gen, ok := f.Decls[0].(*ast.GenDecl)
+	if !ok || gen.Tok != token.IMPORT || len(gen.Specs) != 1 || !gen.Lparen.IsValid() {
+		return
+	}
+	for _, cg := range f.Comments {
+		if gen.Lparen < cg.Pos() && cg.End() < gen.Rparen {
+			return
+		}
+	}
+	gen.Lparen, gen.Rparen = token.NoPos, token.NoPos
+}
+
+// applySpans returns src with spans applied; base is the offset of src in
+// the file the spans refer to.
+func applySpans(src []byte, spans []span, base int) ([]byte, error) {
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var buf bytes.Buffer
+	last := 0
+	for _, s := range spans {
+		start, end := s.start-base, s.end-base
+		if start < last || end > len(src) {
+			return nil, fmt.Errorf("overlapping edits at offset %d", s.start)
+		}
+		buf.Write(src[last:start])
+		buf.WriteString(s.text)
+		last = end
+	}
+	buf.Write(src[last:])
+	return buf.Bytes(), nil
+}
+
+// importCycle returns the cycle through the destination package in the
+// import graph of the packages after the move, if there is one. The
+// packages of the diagram import what their files import, the others what
+// they were loaded with.
+func (m *mover) importCycle(contents map[string]*movedFile) []string {
+	graph := map[string]map[string]bool{}
+	edge := func(from, to string) {
+		if graph[from] == nil {
+			graph[from] = map[string]bool{}
+		}
+		graph[from][to] = true
+	}
+	fileImports := func(from string, f *ast.File) {
+		for _, spec := range f.Imports {
+			if p, err := strconv.Unquote(spec.Path.Value); err == nil {
+				edge(from, p)
+			}
+		}
+	}
+
+	packages.Visit(m.loaded, nil, func(pkg *packages.Package) {
+		for _, f := range pkg.Syntax {
+			if fname := m.fset.File(f.Pos()).Name(); m.files[fname] {
+				if file, ok := contents[fname]; ok {
+					fileImports(pkg.PkgPath, file.f)
+				} else {
+					fileImports(pkg.PkgPath, f)
+				}
+			}
+		}
+		if len(pkg.Syntax) == 0 || !m.files[m.fset.File(pkg.Syntax[0].Pos()).Name()] {
+			for _, imp := range pkg.Imports {
+				edge(pkg.PkgPath, imp.PkgPath)
+			}
+		}
+	})
+	if file, ok := contents[m.dest]; ok {
+		fileImports(m.dstPath, file.f)
+	}
+
+	// Breadth-first from the destination back to itself.
+	prev := map[string]string{}
+	queue := []string{m.dstPath}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, to := range sortedKeys(graph[from]) {
+			if to == m.dstPath {
+				cycle := []string{to}
+				for p := from; p != m.dstPath; p = prev[p] {
+					cycle = append([]string{p}, cycle...)
+				}
+				return append([]string{m.dstPath}, cycle...)
+			}
+			if _, seen := prev[to]; !seen {
+				prev[to] = from
+				queue = append(queue, to)
+			}
+		}
+	}
+	return nil
+}
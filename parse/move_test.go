@@ -0,0 +1,234 @@
+package parse
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModule writes files, by slash-separated name, to a new directory and
+// returns it along with the packages of the directories that hold them, tests
+// included as the Parser does.
+func writeModule(t *testing.T, files map[string]string) (string, map[string]*ast.Package) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	dir := t.TempDir()
+	dirs := map[string]bool{}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".go") {
+			dirs[filepath.Dir(path)] = true
+		}
+	}
+	pkgs := map[string]*ast.Package{}
+	fset := token.NewFileSet()
+	for d := range dirs {
+		parsed, err := parser.ParseDir(fset, d, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, p := range parsed {
+			pkgs[name] = p
+		}
+	}
+	return dir, pkgs
+}
+
+// applyEdits writes the edits and checks that the module still builds and
+// passes vet, tests included.
+func applyEdits(t *testing.T, dir string, edits []FileEdit) map[string]string {
+	t.Helper()
+	contents := map[string]string{}
+	for _, edit := range edits {
+		if err := os.MkdirAll(filepath.Dir(edit.Name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(edit.Name, edit.New, 0644); err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(dir, edit.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[filepath.ToSlash(rel)] = string(edit.New)
+	}
+	cmd := exec.Command("go", "vet", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		var files []string
+		for name, content := range contents {
+			files = append(files, "== "+name+"\n"+content)
+		}
+		t.Fatalf("go vet: %v\n%s\n%s", err, out, strings.Join(files, "\n"))
+	}
+	return contents
+}
+
+const moveModule = "module m\n\ngo 1.21\n"
+
+func TestMoveToOtherPackage(t *testing.T) {
+	dir, pkgs := writeModule(t, map[string]string{
+		"go.mod": moveModule,
+		"a/a.go": `package a
+
+import "time"
+
+// Limit is shared.
+const Limit = 3
+
+// Job is moved.
+type Job struct {
+	Every time.Duration
+	Next  *Job
+}
+
+// Run runs j.
+func (j *Job) Run() int { return Limit } // trailing comment
+`,
+		"a/a_test.go": `package a_test
+
+import (
+	"testing"
+
+	"m/a"
+)
+
+func TestJob(t *testing.T) { _ = a.Job{} }
+`,
+		"b/b.go": `package b
+
+import "m/a"
+
+var K a.Job
+`,
+		"c/c.go": "package c\n",
+	})
+
+	edits, id, err := RenderMove(context.Background(), pkgs, "a.Job", filepath.Join(dir, "c", "c.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "c.Job" {
+		t.Errorf("id = %s, want c.Job", id)
+	}
+	contents := applyEdits(t, dir, edits)
+
+	for _, want := range []string{"type Job struct", "func (j *Job) Run() int { return a.Limit } // trailing comment", "// Job is moved.", `"time"`, `"m/a"`} {
+		if !strings.Contains(contents["c/c.go"], want) {
+			t.Errorf("c/c.go lacks %q:\n%s", want, contents["c/c.go"])
+		}
+	}
+	if strings.Contains(contents["a/a.go"], "type Job") || strings.Contains(contents["a/a.go"], `"time"`) {
+		t.Errorf("a/a.go still has Job or its import:\n%s", contents["a/a.go"])
+	}
+	if !strings.Contains(contents["a/a_test.go"], "_ = c.Job{}") {
+		t.Errorf("references in a/a_test.go are not qualified:\n%s", contents["a/a_test.go"])
+	}
+	if !strings.Contains(contents["b/b.go"], "var K c.Job") {
+		t.Errorf("references in b/b.go are not requalified:\n%s", contents["b/b.go"])
+	}
+}
+
+func TestMoveIntoItsReferences(t *testing.T) {
+	dir, pkgs := writeModule(t, map[string]string{
+		"go.mod": moveModule,
+		"a/a.go": "package a\n\ntype Job struct{ N int }\n",
+		"b/b.go": "package b\n\nimport \"m/a\"\n\nfunc Use(j a.Job) int { return j.N }\n",
+	})
+	edits, _, err := RenderMove(context.Background(), pkgs, "a.Job", filepath.Join(dir, "b", "b.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := applyEdits(t, dir, edits)
+	if strings.Contains(contents["b/b.go"], "m/a") || !strings.Contains(contents["b/b.go"], "func Use(j Job) int") {
+		t.Errorf("b/b.go still refers to package a:\n%s", contents["b/b.go"])
+	}
+}
+
+func TestMoveToNewPackage(t *testing.T) {
+	dir, pkgs := writeModule(t, map[string]string{
+		"go.mod": moveModule,
+		"a/a.go": "package a\n\ntype Job struct{ N int }\n\nfunc (j Job) Double() int { return 2 * j.N }\n\nvar J = Job{N: 1}\n",
+	})
+	edits, id, err := RenderMove(context.Background(), pkgs, "a.Job", filepath.Join(dir, "jobs", "job.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "jobs.Job" {
+		t.Errorf("id = %s, want jobs.Job", id)
+	}
+	created := false
+	for _, edit := range edits {
+		if strings.HasSuffix(edit.Name, filepath.Join("jobs", "job.go")) {
+			created = edit.Old == nil
+		}
+	}
+	if !created {
+		t.Error("the new file has no edit with a nil Old")
+	}
+	contents := applyEdits(t, dir, edits)
+	if !strings.HasPrefix(contents["jobs/job.go"], "package jobs\n") || !strings.Contains(contents["jobs/job.go"], "func (j Job) Double() int") {
+		t.Errorf("jobs/job.go:\n%s", contents["jobs/job.go"])
+	}
+	if !strings.Contains(contents["a/a.go"], "var J = jobs.Job{N: 1}") {
+		t.Errorf("references in a/a.go are not qualified:\n%s", contents["a/a.go"])
+	}
+}
+
+func TestMoveWithinPackage(t *testing.T) {
+	dir, pkgs := writeModule(t, map[string]string{
+		"go.mod": moveModule,
+		"a/a.go": "package a\n\ntype (\n\tJob struct{ N int }\n\tOther int\n)\n\nfunc (j *Job) Inc() { j.N++ }\n",
+		"a/b.go": "package a\n",
+	})
+	edits, id, err := RenderMove(context.Background(), pkgs, "a.Job", filepath.Join(dir, "a", "b.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "a.Job" {
+		t.Errorf("id = %s, want a.Job", id)
+	}
+	contents := applyEdits(t, dir, edits)
+	if !strings.Contains(contents["a/b.go"], "type Job struct{ N int }") || !strings.Contains(contents["a/b.go"], "func (j *Job) Inc()") {
+		t.Errorf("a/b.go:\n%s", contents["a/b.go"])
+	}
+	if strings.Contains(contents["a/a.go"], "Job") {
+		t.Errorf("a/a.go still has Job:\n%s", contents["a/a.go"])
+	}
+}
+
+func TestMoveRefused(t *testing.T) {
+	dir, pkgs := writeModule(t, map[string]string{
+		"go.mod": moveModule,
+		"a/a.go": "package a\n\nimport \"m/b\"\n\nvar limit = 3\n\ntype Job struct{ T *Task }\n\ntype Task struct{ N int }\n\nfunc (t Task) Max() int { return limit }\n\nvar V = b.V\n",
+		"b/b.go": "package b\n\nvar V = 1\n",
+	})
+	tests := []struct {
+		id, dest, want string
+	}{
+		{"a.Job", "b/job.go", "would create an import cycle: m/b -> m/a -> m/b"},
+		{"a.Task", "c/task.go", "Task refers to limit, which package a does not export"},
+		{"a.Job", "a/a_test.go", "not a Go source file"},
+		{"a.Nope", "b/b.go", "unknown struct a.Nope"},
+	}
+	for _, test := range tests {
+		_, _, err := RenderMove(context.Background(), pkgs, test.id, filepath.Join(dir, filepath.FromSlash(test.dest)))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("moving %s to %s: got %v, want an error containing %q", test.id, test.dest, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+)
+
+// Op is one edit of the model. ID names the entity it applies to, as given
+// by EntityID: the package ID for addStruct, a struct for the other struct
+// operations, addField, addMethod, generate, implement and extractInterface,
+// and a field or method otherwise.
+//
+//	addStruct             Name, File
+//	renameStruct          Name
+//	deleteStruct
+//	moveStruct            File, in this package or another, see RenderMove
+//	addField              Name, FieldType
+//	renameField           Name
+//	changeFieldType       FieldType
+//	deleteField
+//	addMethod             Name, Parameters, ReturnType
+//	renameMethod          Name
+//	deleteMethod
+//	generate              Generators, GenFile, see Generators
+//	implement             Interface, see RenderImplement
+//	extractInterface      Name, Methods, Replace, see RenderExtractInterface
+type Op struct {
+	Op         string      `json:"op"`
+	ID         string      `json:"id"`
+	Name       string      `json:"name,omitempty"`
+	FieldType  string      `json:"fieldType,omitempty"`
+	Parameters []Parameter `json:"parameters,omitempty"`
+	ReturnType []Type      `json:"returnType,omitempty"`
+	File       string      `json:"file,omitempty"`
+	Generators []string    `json:"generators,omitempty"`
+	GenFile    bool        `json:"genFile,omitempty"`
+	Interface  string      `json:"interface,omitempty"`
+	Methods    []string    `json:"methods,omitempty"`
+	Replace    bool        `json:"replaceUsages,omitempty"`
+}
+
+// RenderOp computes the file edits op makes, without writing them, and
+// returns the ID of the entity it leaves: the renamed or added one, the
+// same one for other edits, or "" for a deletion. Like
+// RenderClientPackages, it reads the files of the package from disk and uses
+// pkgs only to know which files belong to it. Renames and moves update
+// references too, see RenderRename and RenderMove.
+func RenderOp(ctx context.Context, pkgs map[string]*ast.Package, op Op) ([]FileEdit, string, error) {
+	want := 2
+	switch op.Op {
+	case "addStruct":
+		want = 1
+	case "renameField", "changeFieldType", "deleteField", "renameMethod", "deleteMethod":
+		want = 3
+	case "renameStruct", "deleteStruct", "moveStruct", "addField", "addMethod", "generate",
+		"implement", "extractInterface":
+	default:
+		return nil, "", fmt.Errorf("unknown operation %q", op.Op)
+	}
+	parts, err := splitID(pkgs, op.ID, want)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op.Op, err)
+	}
+	switch op.Op {
+	case "addStruct", "renameStruct", "addField", "renameField", "addMethod", "renameMethod", "extractInterface":
+		if !token.IsIdentifier(op.Name) {
+			return nil, "", fmt.Errorf("%s: invalid name %q", op.Op, op.Name)
+		}
+	}
+
+	switch op.Op {
+	case "renameStruct", "renameField", "renameMethod":
+		edits, err := RenderRename(ctx, pkgs, op.ID, op.Name)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s: %w", op.Op, op.ID, err)
+		}
+		return edits, EntityID(append(parts[:len(parts)-1:len(parts)-1], op.Name)...), nil
+	case "moveStruct":
+		edits, id, err := RenderMove(ctx, pkgs, op.ID, op.File)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s: %w", op.Op, op.ID, err)
+		}
+		return edits, id, nil
+	case "implement":
+		edits, err := RenderImplement(ctx, pkgs, op.ID, op.Interface)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s: %w", op.Op, op.ID, err)
+		}
+		return edits, op.ID, nil
+	case "extractInterface":
+		edits, id, err := RenderExtractInterface(ctx, pkgs, op.ID, op.Name, op.Methods, op.Replace)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s: %w", op.Op, op.ID, err)
+		}
+		return edits, id, nil
+	}
+
+	p, err := loadOpPackage(pkgs, parts[0])
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := p.apply(op, parts)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s %s: %w", op.Op, op.ID, err)
+	}
+	edits, err := p.edits()
+	if err != nil {
+		return nil, "", err
+	}
+	return edits, id, nil
+}
+
+// CheckVersions refuses, with a ConflictError, edits made against versions
+// of files, as given by FileVersion, that are no longer those on disk or no
+// longer exist.
+func CheckVersions(versions map[string]string) error {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src, err := ioutil.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return &ConflictError{File: name, Removed: true}
+		}
+		if err != nil {
+			return err
+		}
+		if version := FileVersion(src); version != versions[name] {
+			return &ConflictError{File: name, Version: version}
+		}
+	}
+	return nil
+}
+
+// opPackage holds the files of a package parsed for an operation, sharing
+// one FileSet so that declarations can move between them.
+type opPackage struct {
+	id    string
+	name  string
+	fset  *token.FileSet
+	files []*opFile
+}
+
+type opFile struct {
+	name     string
+	old      []byte
+	f        *ast.File
+	comments ast.CommentMap
+	changed  bool
+	tail     []interface{}
+	// src is the source f was parsed from: old, or a package clause for a
+	// file the operation creates, whose old is nil.
+	src []byte
+}
+
+func loadOpPackage(pkgs map[string]*ast.Package, id string) (*opPackage, error) {
+	astpkg, ok := pkgs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown package %s", id)
+	}
+	names := make([]string, 0, len(astpkg.Files))
+	for fname := range astpkg.Files {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+
+	p := &opPackage{id: id, name: astpkg.Name, fset: token.NewFileSet()}
+	for _, fname := range names {
+		old, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parser.ParseFile(p.fset, fname, old, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, &opFile{
+			name:     fname,
+			old:      old,
+			src:      old,
+			f:        f,
+			comments: ast.NewCommentMap(p.fset, f, f.Comments),
+		})
+	}
+	return p, nil
+}
+
+// edits renders the files the operation changed.
+func (p *opPackage) edits() ([]FileEdit, error) {
+	var edits []FileEdit
+	for _, file := range p.files {
+		if !file.changed && len(file.tail) == 0 {
+			continue
+		}
+		src, err := renderFile(p.fset, file.name, file.src, file.f, file.comments, file.changed, file.tail)
+		if err != nil {
+			return nil, err
+		}
+		if file.old == nil || !bytes.Equal(file.old, src) {
+			edits = append(edits, FileEdit{Name: file.name, Old: file.old, New: src})
+		}
+	}
+	return edits, nil
+}
+
+func (p *opPackage) file(name string) (*opFile, error) {
+	for _, file := range p.files {
+		if file.name == name {
+			return file, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown file %s in package %s", name, p.name)
+}
+
+// newFile adds a file named name, holding only the package clause, to the
+// package.
+func (p *opPackage) newFile(name string) (*opFile, error) {
+	src := []byte("package " + p.name + "\n")
+	f, err := parser.ParseFile(p.fset, name, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	file := &opFile{name: name, src: src, f: f, comments: ast.NewCommentMap(p.fset, f, f.Comments)}
+	p.files = append(p.files, file)
+	return file, nil
+}
+
+// lookupStruct finds the declaration of a struct type.
+func (p *opPackage) lookupStruct(name string) (*opFile, *ast.TypeSpec, error) {
+	for _, file := range p.files {
+		for _, decl := range file.f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if _, isStruct := ts.Type.(*ast.StructType); isStruct && ts.Name.Name == name {
+					return file, ts, nil
+				}
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown struct %s", EntityID(p.id, name))
+}
+
+// methods returns the methods of typeName in every file of the package.
+func (p *opPackage) methods(typeName string) map[*opFile][]*ast.FuncDecl {
+	methods := map[*opFile][]*ast.FuncDecl{}
+	for _, file := range p.files {
+		if decls := methodDecls(file.f, typeName); len(decls) > 0 {
+			methods[file] = decls
+		}
+	}
+	return methods
+}
+
+// lookupField finds a field of a struct by name: the field declaration and
+// the index of the name in it.
+func lookupField(st *ast.StructType, name string) (*ast.Field, int) {
+	for _, field := range st.Fields.List {
+		for i, ident := range field.Names {
+			if ident.Name == name {
+				return field, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+func (p *opPackage) lookupMethod(typeName, name string) (*opFile, *ast.FuncDecl) {
+	for file, decls := range p.methods(typeName) {
+		for _, decl := range decls {
+			if decl.Name.Name == name {
+				return file, decl
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (p *opPackage) apply(op Op, parts []string) (string, error) {
+	if op.Op == "addStruct" {
+		file, err := p.file(op.File)
+		if err != nil {
+			return "", err
+		}
+		if _, _, err := p.lookupStruct(op.Name); err == nil {
+			return "", fmt.Errorf("struct %s already exists", op.Name)
+		}
+		file.tail = append(file.tail, &ast.GenDecl{
+			Tok: token.TYPE,
+			Specs: []ast.Spec{&ast.TypeSpec{
+				Name: ast.NewIdent(op.Name),
+				Type: &ast.StructType{Fields: &ast.FieldList{}},
+			}},
+		})
+		return EntityID(p.id, op.Name), nil
+	}
+
+	file, ts, err := p.lookupStruct(parts[1])
+	if err != nil {
+		return "", err
+	}
+	st := ts.Type.(*ast.StructType)
+	structID := EntityID(p.id, ts.Name.Name)
+
+	switch op.Op {
+	case "deleteStruct":
+		for mfile, decls := range p.methods(ts.Name.Name) {
+			removeDecls(mfile.f, decls)
+			mfile.changed = true
+		}
+		removeTypeSpec(file.f, ts)
+		file.changed = true
+		return "", nil
+
+	case "addField":
+		if field, _ := lookupField(st, op.Name); field != nil {
+			return "", fmt.Errorf("struct %s already has a field %s", ts.Name.Name, op.Name)
+		}
+		fieldType, err := parseType(op.FieldType)
+		if err != nil {
+			return "", fmt.Errorf("error parsing type of field %s: %w", op.Name, err)
+		}
+		st.Fields.List = append(st.Fields.List, &ast.Field{Names: []*ast.Ident{ast.NewIdent(op.Name)}, Type: fieldType})
+		placeFields(st.Fields)
+		file.changed = true
+		return EntityID(structID, op.Name), nil
+
+	case "addMethod":
+		if mfile, _ := p.lookupMethod(ts.Name.Name, op.Name); mfile != nil {
+			return "", fmt.Errorf("struct %s already has a method %s", ts.Name.Name, op.Name)
+		}
+		stub, err := methodStub(receiverField(ts.Name.Name, methodDecls(file.f, ts.Name.Name)), Method{
+			Name:       op.Name,
+			Parameters: op.Parameters,
+			ReturnType: op.ReturnType,
+		})
+		if err != nil {
+			return "", err
+		}
+		file.tail = append(file.tail, stub)
+		return EntityID(structID, op.Name), nil
+
+	case "generate":
+		if err := p.generate(file, ts, op.Generators, op.GenFile); err != nil {
+			return "", err
+		}
+		return structID, nil
+	}
+
+	member := parts[2]
+	switch op.Op {
+	case "deleteMethod":
+		mfile, decl := p.lookupMethod(ts.Name.Name, member)
+		if decl == nil {
+			return "", fmt.Errorf("struct %s has no method %s", ts.Name.Name, member)
+		}
+		removeDecls(mfile.f, []*ast.FuncDecl{decl})
+		mfile.changed = true
+		return "", nil
+	}
+
+	field, i := lookupField(st, member)
+	if field == nil {
+		return "", fmt.Errorf("struct %s has no field %s", ts.Name.Name, member)
+	}
+	file.changed = true
+	switch op.Op {
+	case "changeFieldType":
+		fieldType, err := parseType(op.FieldType)
+		if err != nil {
+			return "", fmt.Errorf("error parsing type of field %s: %w", member, err)
+		}
+		if len(field.Names) == 1 {
+			field.Type = fieldType
+			return EntityID(structID, member), nil
+		}
+		// Split the name off a declaration like "X, Y float64".
+		var fields []*ast.Field
+		if i > 0 {
+			fields = append(fields, &ast.Field{Names: field.Names[:i], Type: field.Type, Tag: field.Tag})
+		}
+		fields = append(fields, &ast.Field{Names: field.Names[i : i+1], Type: fieldType, Tag: field.Tag})
+		if i < len(field.Names)-1 {
+			fields = append(fields, &ast.Field{Names: field.Names[i+1:], Type: field.Type, Tag: field.Tag})
+		}
+		fields[0].Doc, fields[len(fields)-1].Comment = field.Doc, field.Comment
+		replaceField(st, field, fields...)
+		return EntityID(structID, member), nil
+
+	default: // deleteField
+		if len(field.Names) == 1 {
+			replaceField(st, field)
+		} else {
+			field.Names = append(field.Names[:i:i], field.Names[i+1:]...)
+		}
+		return "", nil
+	}
+}
+
+// replaceField replaces field in st with fields, which may be none.
+func replaceField(st *ast.StructType, field *ast.Field, fields ...*ast.Field) {
+	var list []*ast.Field
+	for _, f := range st.Fields.List {
+		if f == field {
+			list = append(list, fields...)
+			continue
+		}
+		list = append(list, f)
+	}
+	last := st.Fields.List[len(st.Fields.List)-1]
+	st.Fields.List = list
+	if last == field && len(fields) == 0 {
+		closeFields(st.Fields, field)
+	}
+}
@@ -0,0 +1,33 @@
+package parse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckVersions(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(a, []byte("package a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	current := FileVersion([]byte("package a\n"))
+	if stale := FileVersion([]byte("package a\n\n")); stale == current || len(current) != 16 {
+		t.Fatalf("FileVersion gives %s and %s", current, stale)
+	}
+
+	if err := CheckVersions(map[string]string{a: current}); err != nil {
+		t.Errorf("current version: %v", err)
+	}
+	var conflict *ConflictError
+	err := CheckVersions(map[string]string{a: "0123456789abcdef"})
+	if !errors.As(err, &conflict) || conflict.File != a || conflict.Version != current || conflict.Removed {
+		t.Errorf("stale version: got %v, want a conflict with version %s", err, current)
+	}
+	err = CheckVersions(map[string]string{a: current, filepath.Join(dir, "gone.go"): current})
+	if !errors.As(err, &conflict) || conflict.File != filepath.Join(dir, "gone.go") || !conflict.Removed {
+		t.Errorf("removed file: got %v, want a conflict", err)
+	}
+}
@@ -1,16 +1,22 @@
+// Package parse extracts a diagram model of the structs, methods and
+// functions of a Go source tree, and writes edits to the model back.
 package parse
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"go/ast"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io/ioutil"
-	"log"
-	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -19,36 +25,67 @@ type Type struct {
 	Structs []string `json:"structs"`
 }
 
+// ClientStruct is the model of a diagram. The per-file results it is merged
+// from are persisted by the on-disk cache, so a change to this type or any
+// type it holds must come with a bump of Version.
 type ClientStruct struct {
-	Packages        []Package  `json:"packages"`
-	Edges           []Edge     `json:"edges"`
-	GlobalFunctions []Function `json:"globalFunctions"`
+	Packages        []Package    `json:"packages"`
+	Edges           []Edge       `json:"edges"`
+	GlobalFunctions []Function   `json:"globalFunctions"`
+	Diagnostics     []Diagnostic `json:"diagnostics"`
 }
 
+// Package is a package of the diagram. Its ID, see PackageID, tells apart
+// packages of the same name in different directories and starts the entity
+// IDs of its structs. A package the model adds has no ID.
 type Package struct {
+	ID    string `json:"id,omitempty"`
 	Name  string `json:"name"`
 	Files []File `json:"files"`
 }
 
 type File struct {
-	Name    string   `json:"name"`
-	Structs []Struct `json:"structs"`
+	Name       string      `json:"name"`
+	Version    string      `json:"version,omitempty"`
+	Structs    []Struct    `json:"structs"`
+	Interfaces []Interface `json:"interfaces"`
 }
 
+// Struct is a struct type: its named fields, the types it embeds and its
+// methods. Embedded fields are read only; writing a model back leaves them
+// as they are in the source.
 type Struct struct {
-	Name    string   `json:"name"`
-	Fields  []Field  `json:"fields"`
-	Methods []Method `json:"methods"`
+	ID       string   `json:"id,omitempty"`
+	Name     string   `json:"name"`
+	Fields   []Field  `json:"fields"`
+	Embedded []string `json:"embedded"`
+	Methods  []Method `json:"methods"`
+}
+
+// Interface is an interface type: its own methods and the interfaces (or,
+// for constraints, type sets) it embeds.
+type Interface struct {
+	Name     string   `json:"name"`
+	Methods  []Method `json:"methods"`
+	Embedded []string `json:"embedded"`
 }
 
 type Field struct {
+	ID   string `json:"id,omitempty"`
 	Name string `json:"name"`
 	Type Type   `json:"type"`
 }
 
 type Method struct {
-	Name       string `json:"name"`
-	ReturnType []Type `json:"returnType"`
+	ID         string      `json:"id,omitempty"`
+	Name       string      `json:"name"`
+	Parameters []Parameter `json:"parameters"`
+	ReturnType []Type      `json:"returnType"`
+	// Pointer is set for a method with a pointer receiver.
+	Pointer bool `json:"pointer,omitempty"`
+	// File is the file declaring the method when it is not the file of
+	// its struct. Writing a model back leaves such methods alone.
+	File string `json:"file,omitempty"`
 }
 
 type Function struct {
@@ -76,8 +113,29 @@ type Edge struct {
 	From *Node `json:"from"`
 }
 
-func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, packageName string) (File, []Edge, []Function) {
+// recvMethod is a method declared in a file other than the one of its
+// struct; the Parser attaches it once every file of the package is parsed.
+type recvMethod struct {
+	Struct string `json:"struct"`
+	Method Method `json:"method"`
+}
+
+// GetStructsFile builds the part of the model declared in f, a file of the
+// package pkgID, see PackageID. Methods are attached to the structs of f
+// wherever they are declared in it; methods of structs declared in other
+// files are left out.
+func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, pkgID string) (File, []Edge, []Function) {
+	file, edges, functions, _ := getStructsFile(fset, f, fname, pkgID)
+	return file, edges, functions
+}
+
+// getStructsFile is GetStructsFile that also returns the methods whose
+// struct is not declared in f.
+func getStructsFile(fset *token.FileSet, f *ast.File, fname string, pkgID string) (File, []Edge, []Function, []recvMethod) {
+	packageName := f.Name.Name
 	structs := []Struct{}
+	var methods []recvMethod
+	interfaces := []Interface{}
 	edges := []Edge{}
 	globalFunctions := []Function{}
 
@@ -89,15 +147,16 @@ func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, packageName
 					if ts, ok := s.(*ast.TypeSpec); ok {
 						if st, ok := ts.Type.(*ast.StructType); ok {
 							fields := []Field{}
+							embedded := []string{}
 							for _, field := range st.Fields.List {
+								if len(field.Names) == 0 {
+									embedded = append(embedded, formatExpr(fset, field.Type))
+									continue
+								}
 								for _, name := range field.Names {
-									var buf bytes.Buffer
-									if err := format.Node(&buf, fset, field.Type); err != nil {
-										panic(err)
-									}
 									stname, toNodes := GetTypes(field.Type, packageName)
-									fieldtype := Type{Literal: string(buf.Bytes()), Structs: stname}
-									fi := Field{Name: name.Name, Type: fieldtype}
+									fieldtype := Type{Literal: formatExpr(fset, field.Type), Structs: stname}
+									fi := Field{ID: EntityID(pkgID, ts.Name.Name, name.Name), Name: name.Name, Type: fieldtype}
 									fields = append(fields, fi)
 
 									for _, toNode := range toNodes {
@@ -113,7 +172,10 @@ func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, packageName
 									}
 								}
 							}
-							structs = append(structs, Struct{Name: ts.Name.Name, Fields: fields})
+							structs = append(structs, Struct{ID: EntityID(pkgID, ts.Name.Name), Name: ts.Name.Name, Fields: fields, Embedded: embedded})
+						}
+						if it, ok := ts.Type.(*ast.InterfaceType); ok {
+							interfaces = append(interfaces, getInterface(fset, ts.Name.Name, it))
 						}
 					}
 				}
@@ -121,26 +183,15 @@ func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, packageName
 		case *ast.FuncDecl:
 			if decl.Recv != nil && len(decl.Recv.List) > 0 {
 				// This is a method
-				recvType := decl.Recv.List[0].Type
-				var structName string
-				if starExpr, ok := recvType.(*ast.StarExpr); ok {
-					structName = starExpr.X.(*ast.Ident).Name
-				} else {
-					structName = recvType.(*ast.Ident).Name
-				}
+				structName := receiverName(decl.Recv.List[0].Type)
 
-				method := Method{
+				methods = append(methods, recvMethod{Struct: structName, Method: Method{
+					ID:         EntityID(pkgID, structName, decl.Name.Name),
 					Name:       decl.Name.Name,
+					Parameters: parseParameters(decl.Type.Params),
 					ReturnType: parseReturnTypes(decl.Type.Results),
-				}
-
-				// Find the struct and add the method
-				for i, s := range structs {
-					if s.Name == structName {
-						structs[i].Methods = append(structs[i].Methods, method)
-						break
-					}
-				}
+					Pointer:    isPointer(decl.Recv.List[0].Type),
+				}})
 			} else {
 				// This is a global function
 				globalFunctions = append(globalFunctions, Function{
@@ -154,154 +205,254 @@ func GetStructsFile(fset *token.FileSet, f *ast.File, fname string, packageName
 		}
 	}
 
-	return File{Name: fname, Structs: structs}, edges, globalFunctions
-}
-
-func GetFileName(toNode *Node, pkgs []Package) string {
-	for _, pkg := range pkgs {
-		if pkg.Name == toNode.PackageName {
-			for _, file := range pkg.Files {
-				for _, st := range file.Structs {
-					if st.Name == toNode.StructName {
-						return file.Name
-					}
-				}
-			}
+	// Methods may come before their struct; those of no struct in f are
+	// returned for the Parser to attach.
+	var others []recvMethod
+	for _, m := range methods {
+		if !attachMethod(structs, m) {
+			m.Method.File = fname
+			others = append(others, m)
 		}
 	}
-	fmt.Println("Matching file not found for struct", toNode.StructName, "(probably a library package)")
-	return ""
+	return File{Name: fname, Structs: structs, Interfaces: interfaces}, edges, globalFunctions, others
 }
 
-func getPackagesEdgesDirName(fset *token.FileSet, packages map[string]*ast.Package) ([]Package, []Edge, []Function, error) {
-	var pkgs []Package
-	var edges []Edge
-	var globalFunctions []Function
-
-	for packagename, packageval := range packages {
-		files := []File{}
-		for fname, f := range packageval.Files {
-			newfile, newedges, newFunctions := GetStructsFile(fset, f, fname, packagename)
-			files = append(files, newfile)
-			edges = append(edges, newedges...)
-			globalFunctions = append(globalFunctions, newFunctions...)
-			log.Printf("Parsed file: %s", fname)
+// attachMethod adds m to its struct in structs, if it is there.
+func attachMethod(structs []Struct, m recvMethod) bool {
+	for i := range structs {
+		if structs[i].Name == m.Struct {
+			structs[i].Methods = append(structs[i].Methods, m.Method)
+			return true
 		}
-		pkgs = append(pkgs, Package{Name: packagename, Files: files})
 	}
+	return false
+}
 
-	return pkgs, edges, globalFunctions, nil
+// EntityID identifies a struct, "pkg.Struct", or one of its fields or
+// methods, "pkg.Struct.Name", in edit operations, where pkg is the ID of its
+// package, see PackageID. Fields and methods of a type cannot share a name,
+// so one form serves both.
+func EntityID(parts ...string) string {
+	return strings.Join(parts, ".")
 }
 
-func parseDirectory(path string) (map[string]*ast.Package, error) {
-	fset := token.NewFileSet()
-	packages, err := parser.ParseDir(fset, path, nil, 0)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing directory %s: %w", path, err)
+// PackageID identifies the package name declared in dir, the slash-separated
+// directory relative to the root of the diagram, "." for the root itself.
+// It is dir, with "_test" appended for an external test package, as go list
+// names them: "internal/util", "cmd/util", "internal/util_test".
+func PackageID(dir, name string) string {
+	if strings.HasSuffix(name, "_test") {
+		return dir + "_test"
 	}
+	return dir
+}
 
-	// Логгируем файлы, которые не были спарсены
-	err = filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+// diagramRoot returns the directory the IDs of the packages of the diagram
+// are relative to, given astpkg, the package of ID id.
+func diagramRoot(astpkg *ast.Package, id string) string {
+	dir := id
+	if strings.HasSuffix(astpkg.Name, "_test") {
+		dir = strings.TrimSuffix(id, "_test")
+	}
+	for fname := range astpkg.Files {
+		root, err := filepath.Abs(filepath.Dir(fname))
 		if err != nil {
-			return err
+			break
 		}
-		if f.IsDir() && (strings.Contains(path, ".git") || strings.Contains(path, "node_modules")) {
-			return nil
+		if dir != "." {
+			for range strings.Split(dir, "/") {
+				root = filepath.Dir(root)
+			}
 		}
-		if f.IsDir() || filepath.Ext(path) != ".go" {
-			return nil
+		return root
+	}
+	return ""
+}
+
+// splitID splits an entity ID into the ID of a package of pkgs and the
+// names that follow it, as many as one of counts minus one, tried in turn.
+// Package IDs may hold dots, the names do not.
+func splitID(pkgs map[string]*ast.Package, id string, counts ...int) ([]string, error) {
+	unknown := ""
+	for _, n := range counts {
+		parts := make([]string, n)
+		rest, ok := id, true
+		for i := n - 1; i > 0 && ok; i-- {
+			j := strings.LastIndex(rest, ".")
+			if ok = j >= 0 && token.IsIdentifier(rest[j+1:]); ok {
+				rest, parts[i] = rest[:j], rest[j+1:]
+			}
 		}
-		_, ok := packages[filepath.Base(filepath.Dir(path))]
-		if !ok {
-			log.Printf("Skipped file: %s", path)
+		if !ok || rest == "" {
+			continue
+		}
+		if _, known := pkgs[rest]; known {
+			parts[0] = rest
+			return parts, nil
+		}
+		if unknown == "" {
+			unknown = rest
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error walking directory: %w", err)
 	}
-
-	return packages, nil
+	if unknown != "" {
+		return nil, fmt.Errorf("unknown package %s", unknown)
+	}
+	return nil, fmt.Errorf("invalid id %q", id)
 }
 
-func GetStructsDirName(path string) (*ClientStruct, map[string]*ast.Package, error) {
-	var directories []string
-	err := filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if f.IsDir() && (strings.Contains(path, ".git") || strings.Contains(path, "node_modules")) {
-			return nil
+func getInterface(fset *token.FileSet, name string, it *ast.InterfaceType) Interface {
+	iface := Interface{Name: name, Methods: []Method{}, Embedded: []string{}}
+	for _, field := range it.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			iface.Embedded = append(iface.Embedded, formatExpr(fset, field.Type))
+			continue
 		}
-		if f.IsDir() {
-			directories = append(directories, path)
+		for _, methodName := range field.Names {
+			iface.Methods = append(iface.Methods, Method{
+				Name:       methodName.Name,
+				Parameters: parseParameters(ft.Params),
+				ReturnType: parseReturnTypes(ft.Results),
+			})
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, nil, fmt.Errorf("error walking directory: %w", err)
 	}
+	return iface
+}
 
-	var packages []Package
-	var edges []Edge
-	var globalFunctions []Function
-	pkgmap := map[string]*ast.Package{}
-	fset := token.NewFileSet()
+// receiverName returns the base type name of a method receiver, unwrapping
+// pointers, parentheses and type parameters (e.g. *List[T] -> List).
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.ParenExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	}
+	return ""
+}
 
-	for _, directory := range directories {
-		dirPackages, err := parseDirectory(directory)
-		if err != nil {
-			return nil, nil, err
+// isPointer reports whether a method receiver is a pointer.
+func isPointer(expr ast.Expr) bool {
+	for {
+		switch t := expr.(type) {
+		case *ast.ParenExpr:
+			expr = t.X
+		case *ast.StarExpr:
+			return true
+		default:
+			return false
 		}
+	}
+}
 
-		newpackages, newedges, newFunctions, err := getPackagesEdgesDirName(fset, dirPackages)
-		if err != nil {
-			return nil, nil, err
+func GetFileName(toNode *Node, pkgs []Package) string {
+	for _, pkg := range pkgs {
+		if pkg.Name == toNode.PackageName {
+			for _, file := range pkg.Files {
+				for _, st := range file.Structs {
+					if st.Name == toNode.StructName {
+						return file.Name
+					}
+				}
+			}
 		}
+	}
+	// Probably a library package.
+	return ""
+}
 
-		packages = append(packages, newpackages...)
-		edges = append(edges, newedges...)
-		globalFunctions = append(globalFunctions, newFunctions...)
-		for k, v := range dirPackages {
-			pkgmap[k] = v
-		}
+// GetStructsDirName parses every package below path. It is a one-shot
+// wrapper around Parser.ParseDir with no memory of earlier parses.
+func GetStructsDirName(path string) (*ClientStruct, map[string]*ast.Package, error) {
+	return NewParser().ParseDir(context.Background(), path)
+}
+
+// SortClientStruct puts every collection of the model into a deterministic
+// order, so that an unchanged source tree always produces the same JSON.
+// Packages, files, edges and global functions are sorted by name; structs,
+// fields and methods keep their source order, which is already stable and is
+// what the write-back relies on.
+func SortClientStruct(clientStruct *ClientStruct) {
+	sort.SliceStable(clientStruct.Packages, func(i, j int) bool {
+		return clientStruct.Packages[i].Name < clientStruct.Packages[j].Name
+	})
+	for i := range clientStruct.Packages {
+		files := clientStruct.Packages[i].Files
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Name < files[j].Name
+		})
 	}
 
-	// Fill in filenames for edges
-	validedges := []Edge{}
-	for _, edge := range edges {
-		if name := GetFileName(edge.To, packages); name != "" {
-			edge.To.FileName = name
-			validedges = append(validedges, edge)
+	edges := make([]keyedEdge, len(clientStruct.Edges))
+	for i, edge := range clientStruct.Edges {
+		edges[i] = keyedEdge{key: edgeKey(edge), edge: edge}
+	}
+	sort.SliceStable(edges, func(i, j int) bool {
+		return edges[i].key < edges[j].key
+	})
+	for i := range edges {
+		clientStruct.Edges[i] = edges[i].edge
+	}
+
+	sort.SliceStable(clientStruct.GlobalFunctions, func(i, j int) bool {
+		a, b := clientStruct.GlobalFunctions[i], clientStruct.GlobalFunctions[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.File != b.File {
+			return a.File < b.File
 		}
+		return a.Name < b.Name
+	})
+}
+
+// keyedEdge carries the sort key of an edge so it is built only once.
+type keyedEdge struct {
+	key  string
+	edge Edge
+}
+
+func edgeKey(edge Edge) string {
+	return nodeKey(edge.From) + "->" + nodeKey(edge.To)
+}
+
+func nodeKey(node *Node) string {
+	if node == nil {
+		return ""
 	}
+	return strings.Join([]string{node.PackageName, node.FileName, node.StructName, node.FieldTypeName}, "\x00")
+}
 
-	return &ClientStruct{Packages: packages, Edges: validedges, GlobalFunctions: globalFunctions}, pkgmap, nil
+var primitives = map[string]bool{
+	"bool":       true,
+	"byte":       true,
+	"complex64":  true,
+	"complex128": true,
+	"error":      true,
+	"float32":    true,
+	"float64":    true,
+	"int":        true,
+	"int8":       true,
+	"int16":      true,
+	"int32":      true,
+	"int64":      true,
+	"rune":       true,
+	"string":     true,
+	"uint":       true,
+	"uint8":      true,
+	"uint16":     true,
+	"uint32":     true,
+	"uint64":     true,
+	"uintptr":    true,
 }
 
 func isPrimitive(name string) bool {
-	primitives := map[string]bool{
-		"bool":       true,
-		"byte":       true,
-		"complex64":  true,
-		"complex128": true,
-		"error":      true,
-		"float32":    true,
-		"float64":    true,
-		"int":        true,
-		"int8":       true,
-		"int16":      true,
-		"int32":      true,
-		"int64":      true,
-		"rune":       true,
-		"string":     true,
-		"uint":       true,
-		"uint8":      true,
-		"uint16":     true,
-		"uint32":     true,
-		"uint64":     true,
-		"uintptr":    true,
-	}
 	return primitives[name]
 }
 
@@ -355,6 +506,10 @@ func parseParameters(fieldList *ast.FieldList) []Parameter {
 	}
 	for _, field := range fieldList.List {
 		fieldType := parseTypeToType(field.Type)
+		if len(field.Names) == 0 {
+			params = append(params, Parameter{Type: fieldType})
+			continue
+		}
 		for _, name := range field.Names {
 			params = append(params, Parameter{
 				Name: name.Name,
@@ -371,182 +526,240 @@ func parseReturnTypes(fieldList *ast.FieldList) []Type {
 		return types
 	}
 	for _, field := range fieldList.List {
-		types = append(types, parseTypeToType(field.Type))
+		// Named results may share a type: (x, y int) returns two values.
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		fieldType := parseTypeToType(field.Type)
+		for i := 0; i < n; i++ {
+			types = append(types, fieldType)
+		}
 	}
 	return types
 }
 
 func parseTypeToType(expr ast.Expr) Type {
+	return Type{Literal: formatExpr(token.NewFileSet(), expr)}
+}
+
+// formatExpr prints expr as gofmt would, falling back to the plain
+// go/types notation for expressions the printer rejects.
+func formatExpr(fset *token.FileSet, expr ast.Expr) string {
 	var buf bytes.Buffer
-	if err := format.Node(&buf, token.NewFileSet(), expr); err != nil {
-		log.Printf("Error formatting type: %v", err)
-		return Type{Literal: "error"}
+	if err := format.Node(&buf, fset, expr); err != nil {
+		return types.ExprString(expr)
+	}
+	return buf.String()
+}
+
+// FileEdit is the content of a file on disk and the content an edit of the
+// model gives it. Old is nil for a file the edit creates.
+type FileEdit struct {
+	Name string
+	Old  []byte
+	New  []byte
+}
+
+// FileVersion identifies the content of a file. Models carry the version of
+// each file, and edits made against an older version are refused.
+func FileVersion(content []byte) string {
+	return hashVersion(sha256.Sum256(content))
+}
+
+func hashVersion(hash [sha256.Size]byte) string {
+	return hex.EncodeToString(hash[:8])
+}
+
+// ReadFile parses a single file from disk into its part of the model, with
+// its current version. Entity IDs are relative to root, as the Parser makes
+// them for the diagram of root.
+func ReadFile(root, name string) (File, error) {
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		return File{}, err
 	}
-	return Type{Literal: buf.String()}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return File{}, err
+	}
+	dir, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil {
+		return File{}, err
+	}
+	file, _, _ := GetStructsFile(fset, f, name, PackageID(filepath.ToSlash(dir), f.Name.Name))
+	file.Version = FileVersion(src)
+	return file, nil
 }
 
-func WriteClientPackages(pkgs map[string]*ast.Package, clientpackages []Package) error {
-	var err error
+// RenderClientPackages computes the files WriteClientPackages would write,
+// without touching the disk or the ASTs in pkgs. Each file is parsed afresh
+// from disk, so pkgs, keyed by package ID, is only used to check which
+// packages and files exist.
+// Files the model leaves as they are get no edit. A file whose version in
+// the model is not the one on disk, or which has a version but no longer
+// exists, is refused with a ConflictError. File
+// names in the model are relative to root, see ResolvePath; files and
+// packages the model adds are created inside it, see newFilePath.
+func RenderClientPackages(pkgs map[string]*ast.Package, root string, clientpackages []Package) ([]FileEdit, error) {
+	var edits []FileEdit
+	newDirs := map[string]string{}
 	for _, clientpackage := range clientpackages {
 		for _, clientfile := range clientpackage.Files {
 			packagename := clientpackage.Name
-			packageast := pkgs[packagename]
-			// Get the AST with the matching file name
-			f := packageast.Files[clientfile.Name]
-
-			if f == nil {
-				fmt.Println("Couldn't find", packagename, packageast.Files, clientfile.Name)
+			var old, src []byte
+			name, err := ResolvePath(root, clientfile.Name)
+			if err != nil {
+				return nil, err
+			}
+			// Files loaded from the cache have a nil AST, so only the key
+			// tells that the file exists.
+			packageast, known := pkgs[clientpackage.ID]
+			if known {
+				_, known = packageast.Files[name]
 			}
+			if known {
+				clientfile.Name = name
+				if old, err = ioutil.ReadFile(clientfile.Name); err != nil {
+					return nil, err
+				}
+				if version := FileVersion(old); clientfile.Version != "" && clientfile.Version != version {
+					return nil, &ConflictError{File: clientfile.Name, Version: version}
+				}
+				src = old
+			} else {
+				// A file with a version was on disk when the model was
+				// built; it is not created again.
+				if clientfile.Version != "" {
+					return nil, &ConflictError{File: name, Removed: true}
+				}
+				if clientfile.Name, err = newFilePath(pkgs, root, clientpackage.ID, packagename, clientfile.Name, newDirs); err != nil {
+					return nil, err
+				}
+				// A new file starts from its package clause.
+				src = []byte("package " + packagename + "\n")
+			}
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, clientfile.Name, src, parser.ParseComments)
+			if err != nil {
+				return nil, err
+			}
+			comments := ast.NewCommentMap(fset, f, f.Comments)
 			// Update the AST with the values from the client
-			f, err = clientFileToAST(clientfile, f)
+			changed, newDecls, err := clientFileToAST(fset, clientfile, f)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if old != nil && !changed && len(newDecls) == 0 {
+				continue
 			}
-			writeFileAST(clientfile.Name, f)
+			tail := make([]interface{}, len(newDecls))
+			for i, decl := range newDecls {
+				tail[i] = decl
+			}
+			if src, err = renderFile(fset, clientfile.Name, src, f, comments, changed, tail); err != nil {
+				return nil, err
+			}
+			if old != nil && bytes.Equal(old, src) {
+				continue
+			}
+			edits = append(edits, FileEdit{Name: clientfile.Name, Old: old, New: src})
 		}
 	}
-	return nil
+	return edits, nil
 }
 
-func writeFileAST(filepath string, f *ast.File) {
-	fset := token.NewFileSet()
-	var buf bytes.Buffer
-	if err := format.Node(&buf, fset, f); err != nil {
-		panic(err)
-	}
-	err := ioutil.WriteFile(filepath, buf.Bytes(), 0644)
+// WriteClientPackages writes the edited model back to the source files.
+// Nothing is written unless every file renders; each file is replaced
+// atomically, and the files already written are restored if one fails. Use
+// a Journal to be able to undo the edit.
+func WriteClientPackages(pkgs map[string]*ast.Package, root string, clientpackages []Package) error {
+	edits, err := RenderClientPackages(pkgs, root, clientpackages)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return writeEdits(edits, false)
 }
 
-func clientFileToAST(clientfile File, f *ast.File) (*ast.File, error) {
-	var newDecls []ast.Decl
-	if len(f.Decls) > 0 {
-		newDecls = []ast.Decl{f.Decls[0]}
-	}
-
-	f.Decls = removeStructDecls(f.Decls)
-	newStructs, err := clientFileToDecls(clientfile)
-	if err != nil {
-		return nil, err
-	}
-
-	// Assume import is the first decl. Add typedefs after that
-	newDecls = append(newDecls, newStructs...)
-	if len(f.Decls) > 0 {
-		newDecls = append(newDecls, f.Decls[1:]...)
-	} else {
-		newDecls = append(newDecls, f.Decls...)
-	}
-	f.Decls = newDecls
-	return f, nil
-}
-
-func clientFileToDecls(clientfile File) ([]ast.Decl, error) {
-	var decls []ast.Decl
-
-	for _, clientstruct := range clientfile.Structs {
-		// Create struct declaration
-		structDecl := &ast.GenDecl{
-			Tok: token.TYPE,
-			Specs: []ast.Spec{
-				&ast.TypeSpec{
-					Name: ast.NewIdent(clientstruct.Name),
-					Type: &ast.StructType{
-						Fields: &ast.FieldList{},
-					},
-				},
-			},
+// renderFile returns the source of f, parsed from old with fset: old itself
+// when f is unchanged, else f formatted without the comments of removed
+// nodes. The nodes of tail are formatted on their own and appended, as new
+// declarations have no position in the file; a []byte in tail is source
+// appended as is. Imports are then fixed, see fixImports, which formats the
+// whole file.
+func renderFile(fset *token.FileSet, name string, old []byte, f *ast.File, comments ast.CommentMap, changed bool, tail []interface{}) ([]byte, error) {
+	src := old
+	if changed {
+		f.Comments = keptComments(comments, f)
+		var err error
+		if src, err = formatFileAST(fset, name, f); err != nil {
+			return nil, err
 		}
-
-		for _, clientfield := range clientstruct.Fields {
-			fieldType, err := parseType(clientfield.Type.Literal)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing field type: %w", err)
+	}
+	if len(tail) > 0 {
+		var buf bytes.Buffer
+		buf.Write(bytes.TrimRight(src, "\n"))
+		for _, node := range tail {
+			buf.WriteString("\n\n")
+			if text, ok := node.([]byte); ok {
+				buf.Write(bytes.TrimSpace(text))
+				continue
 			}
-
-			field := &ast.Field{
-				Names: []*ast.Ident{ast.NewIdent(clientfield.Name)},
-				Type:  fieldType,
+			if err := format.Node(&buf, fset, node); err != nil {
+				return nil, fmt.Errorf("error formatting %s: %w", name, err)
 			}
-
-			structDecl.Specs[0].(*ast.TypeSpec).Type.(*ast.StructType).Fields.List = append(
-				structDecl.Specs[0].(*ast.TypeSpec).Type.(*ast.StructType).Fields.List,
-				field,
-			)
 		}
+		buf.WriteByte('\n')
+		src = buf.Bytes()
+	}
+	return fixImports(name, src)
+}
 
-		decls = append(decls, structDecl)
-
-		// Create method declarations
-		for _, clientmethod := range clientstruct.Methods {
-			methodDecl := &ast.FuncDecl{
-				Recv: &ast.FieldList{
-					List: []*ast.Field{
-						{
-							Names: []*ast.Ident{ast.NewIdent("s")},
-							Type:  &ast.StarExpr{X: ast.NewIdent(clientstruct.Name)},
-						},
-					},
-				},
-				Name: ast.NewIdent(clientmethod.Name),
-				Type: &ast.FuncType{
-					Params:  &ast.FieldList{},
-					Results: &ast.FieldList{},
-				},
-			}
-
-			// Add return types
-			for _, returnType := range clientmethod.ReturnType {
-				retType, err := parseType(returnType.Literal)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing return type: %w", err)
-				}
-				methodDecl.Type.Results.List = append(methodDecl.Type.Results.List, &ast.Field{Type: retType})
-			}
+func formatFileAST(fset *token.FileSet, filepath string, f *ast.File) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, fmt.Errorf("error formatting %s: %w", filepath, err)
+	}
+	return buf.Bytes(), nil
+}
 
-			decls = append(decls, methodDecl)
+// keptComments drops the comments of the declarations and fields an edit
+// removed, keeping the order of the rest.
+func keptComments(comments ast.CommentMap, f *ast.File) []*ast.CommentGroup {
+	kept := map[*ast.CommentGroup]bool{}
+	for _, group := range comments.Filter(f).Comments() {
+		kept[group] = true
+	}
+	var groups []*ast.CommentGroup
+	for _, group := range f.Comments {
+		if kept[group] {
+			groups = append(groups, group)
 		}
 	}
-
-	return decls, nil
+	return groups
 }
 
+// parseType parses a type expression for insertion into a file. Its
+// positions are cleared: they are offsets into typeStr, and would otherwise
+// point into whatever file the file's FileSet has first.
 func parseType(typeStr string) (ast.Expr, error) {
 	expr, err := parser.ParseExpr(typeStr)
 	if err != nil {
 		return nil, err
 	}
-	return expr, nil
-}
-
-func removeStructDecls(decls []ast.Decl) []ast.Decl {
-	var newDecls []ast.Decl
-	for _, decl := range decls {
-		switch d := decl.(type) {
-		case *ast.GenDecl:
-			if d.Tok == token.TYPE {
-				var newSpecs []ast.Spec
-				for _, spec := range d.Specs {
-					if ts, ok := spec.(*ast.TypeSpec); ok {
-						if _, isStruct := ts.Type.(*ast.StructType); !isStruct {
-							newSpecs = append(newSpecs, spec)
-						}
-					} else {
-						newSpecs = append(newSpecs, spec)
-					}
-				}
-				if len(newSpecs) > 0 {
-					d.Specs = newSpecs
-					newDecls = append(newDecls, d)
-				}
-			} else {
-				newDecls = append(newDecls, decl)
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Type() == posType {
+				v.Field(i).SetInt(int64(token.NoPos))
 			}
-		default:
-			newDecls = append(newDecls, decl)
 		}
-	}
-	return newDecls
+		return true
+	})
+	return expr, nil
 }
@@ -0,0 +1,629 @@
+package parse
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Diagnostic describes a problem found while parsing a single file.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// fileResult is everything extracted from one source file.
+type fileResult struct {
+	packageName string
+	ast         *ast.File
+	file        File
+	edges       []Edge
+	functions   []Function
+	// methods are those of structs declared in other files.
+	methods []recvMethod
+}
+
+// cacheEntry is the cached state of one source file. result is the last
+// good parse of the file and may be older than hash when the current
+// content does not parse.
+type cacheEntry struct {
+	hash        [sha256.Size]byte
+	result      *fileResult
+	diagnostics []Diagnostic
+}
+
+// Parser parses directory trees file by file. A file that fails to parse
+// does not abort the whole model: it is reported as a Diagnostic and the
+// last good result for that file is used instead, if there is one.
+//
+// Results are cached per file, keyed by path and content hash, so only
+// files that actually changed are parsed again. With a cache directory set,
+// successful results are also persisted and survive a restart. Files are
+// parsed concurrently on a bounded pool of workers.
+type Parser struct {
+	mu      sync.Mutex
+	workers int
+	cache   *diskCache
+	logger  *log.Logger
+	src     *source
+	files   map[string]*cacheEntry
+
+	dirtyMu sync.Mutex
+	dirty   map[string]bool
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		files: map[string]*cacheEntry{},
+		dirty: map[string]bool{},
+	}
+}
+
+// SetWorkers sets the maximum number of files parsed at the same time.
+// Zero or less means runtime.GOMAXPROCS(0).
+func (p *Parser) SetWorkers(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers = workers
+}
+
+// SetCacheDir makes the parser persist its results in dir. An empty dir
+// disables the on-disk cache. A new dir is pruned in the background, see
+// cacheMaxAge and cacheMaxSize.
+func (p *Parser) SetCacheDir(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dir == "" {
+		p.cache = nil
+		return
+	}
+	if p.cache != nil && p.cache.dir == dir {
+		return
+	}
+	cache := &diskCache{dir: dir}
+	p.cache = cache
+	logger := p.logger
+	go func() {
+		if err := cache.prune(cacheMaxAge, cacheMaxSize); err != nil && logger != nil {
+			logger.Printf("Error pruning cache %s: %v", dir, err)
+		}
+	}()
+}
+
+// SetLogger makes the parser report progress to logger. A nil logger,
+// the default, discards everything.
+func (p *Parser) SetLogger(logger *log.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.logger = logger
+}
+
+func (p *Parser) logf(format string, args ...interface{}) {
+	if p.logger != nil {
+		p.logger.Printf(format, args...)
+	}
+}
+
+// source is where a Parser reads files from. Files are addressed by their
+// slash-separated path inside fsys and reported in the model under name.
+type source struct {
+	fsys fs.FS
+	root string // directory inside fsys to parse
+	dir  string // OS directory fsys is rooted at, "" for any other fs.FS
+}
+
+func (s *source) sameAs(other *source) bool {
+	return s != nil && other != nil && s.dir != "" && s.dir == other.dir && s.root == other.root
+}
+
+// name returns the model file name of fsPath.
+func (s *source) name(fsPath string) string {
+	if s.dir == "" {
+		return fsPath
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(fsPath))
+}
+
+// pkgDir returns the directory of fsPath relative to the root, which
+// package IDs are made of, see PackageID.
+func (s *source) pkgDir(fsPath string) string {
+	dir := pathpkg.Dir(fsPath)
+	if s.root == "." || s.root == "" {
+		return dir
+	}
+	if dir == s.root {
+		return "."
+	}
+	return strings.TrimPrefix(dir, s.root+"/")
+}
+
+// fsPath is the inverse of name. It reports false for names outside the
+// source.
+func (s *source) fsPath(name string) (string, bool) {
+	if s.dir == "" {
+		return name, fs.ValidPath(name)
+	}
+	rel, err := filepath.Rel(s.dir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// parseJob is a single file handed to a worker, with the slot its result
+// goes into so that the output order does not depend on scheduling.
+type parseJob struct {
+	index int
+	path  string
+}
+
+// parseOutput is what a worker found for one file. A nil entry means the
+// file no longer exists.
+type parseOutput struct {
+	entry *cacheEntry
+	err   error
+}
+
+// ParseDir parses every package below path and returns the model together
+// with the ASTs grouped by package ID, see PackageID. Files whose content
+// did not change since the last call are taken from the cache. It stops
+// early and returns ctx.Err() when ctx is cancelled.
+func (p *Parser) ParseDir(ctx context.Context, path string) (*ClientStruct, map[string]*ast.Package, error) {
+	return p.parse(ctx, &source{fsys: os.DirFS(path), root: ".", dir: path})
+}
+
+// ParseFS is like ParseDir but reads the packages below root from fsys.
+// Files are named by their path inside fsys.
+func (p *Parser) ParseFS(ctx context.Context, fsys fs.FS, root string) (*ClientStruct, map[string]*ast.Package, error) {
+	return p.parse(ctx, &source{fsys: fsys, root: root})
+}
+
+func (p *Parser) parse(ctx context.Context, src *source) (*ClientStruct, map[string]*ast.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !src.sameAs(p.src) {
+		p.src = src
+		p.files = map[string]*cacheEntry{}
+	}
+
+	// A full walk covers everything invalidated so far.
+	p.dirtyMu.Lock()
+	dirty := p.dirty
+	p.dirty = map[string]bool{}
+	p.dirtyMu.Unlock()
+
+	paths, err := walkGoFiles(ctx, src.fsys, src.root)
+	if err != nil {
+		p.reinvalidate(dirty)
+		return nil, nil, err
+	}
+	if err := p.refreshFiles(ctx, paths); err != nil {
+		p.reinvalidate(dirty)
+		return nil, nil, err
+	}
+
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		seen[path] = true
+	}
+	for path := range p.files {
+		if !seen[path] {
+			delete(p.files, path)
+		}
+	}
+
+	clientStruct, pkgmap := p.merge()
+	return clientStruct, pkgmap, nil
+}
+
+// Invalidate marks files or directories, given by their model name, as
+// changed. They may no longer exist. The next Refresh picks the changes up.
+func (p *Parser) Invalidate(names ...string) {
+	p.dirtyMu.Lock()
+	defer p.dirtyMu.Unlock()
+	for _, name := range names {
+		p.dirty[name] = true
+	}
+}
+
+// Refresh re-parses only the paths passed to Invalidate since the last
+// ParseDir or Refresh and rebuilds the model from the cache. ParseDir must
+// have been called first. When ctx is cancelled the paths stay invalidated
+// for the next call.
+func (p *Parser) Refresh(ctx context.Context) (*ClientStruct, map[string]*ast.Package, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.src == nil {
+		return nil, nil, errors.New("parser has no source, call ParseDir first")
+	}
+
+	p.dirtyMu.Lock()
+	dirty := p.dirty
+	p.dirty = map[string]bool{}
+	p.dirtyMu.Unlock()
+
+	var paths []string
+	for name := range dirty {
+		path, ok := p.src.fsPath(name)
+		if !ok || isExcluded(path) {
+			continue
+		}
+		info, err := fs.Stat(p.src.fsys, path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			p.forget(path)
+		case err != nil:
+			p.logf("Error checking %s: %v", name, err)
+		case info.IsDir():
+			dirPaths, err := walkGoFiles(ctx, p.src.fsys, path)
+			if err != nil {
+				p.reinvalidate(dirty)
+				return nil, nil, err
+			}
+			paths = append(paths, dirPaths...)
+		case pathpkg.Ext(path) == ".go":
+			paths = append(paths, path)
+		}
+	}
+
+	if err := p.refreshFiles(ctx, paths); err != nil {
+		p.reinvalidate(dirty)
+		return nil, nil, err
+	}
+
+	clientStruct, pkgmap := p.merge()
+	return clientStruct, pkgmap, nil
+}
+
+// reinvalidate puts paths taken by an unfinished Refresh back.
+func (p *Parser) reinvalidate(paths map[string]bool) {
+	p.dirtyMu.Lock()
+	defer p.dirtyMu.Unlock()
+	for path := range paths {
+		p.dirty[path] = true
+	}
+}
+
+// forget drops path, and everything below it if it was a directory.
+func (p *Parser) forget(path string) {
+	prefix := path + "/"
+	for cached := range p.files {
+		if cached == path || strings.HasPrefix(cached, prefix) {
+			delete(p.files, cached)
+		}
+	}
+}
+
+// refreshFiles brings the cache entries of paths up to date, parsing only
+// the files whose content hash changed. The work is done on a bounded pool
+// of workers.
+func (p *Parser) refreshFiles(ctx context.Context, paths []string) error {
+	workers := p.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	fset := token.NewFileSet()
+	outputs := make([]parseOutput, len(paths))
+	jobs := make(chan parseJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				entry, err := p.refreshFile(fset, job.path, p.files[job.path])
+				outputs[job.index] = parseOutput{entry: entry, err: err}
+			}
+		}()
+	}
+
+	var err error
+send:
+	for i, path := range paths {
+		select {
+		case jobs <- parseJob{index: i, path: path}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	for i, path := range paths {
+		output := outputs[i]
+		if output.err != nil {
+			return output.err
+		}
+		if output.entry == nil {
+			delete(p.files, path)
+			continue
+		}
+		p.files[path] = output.entry
+	}
+	return nil
+}
+
+// refreshFile returns the up to date cache entry for path. cached is
+// returned as is when the content did not change, and nil is returned when
+// the file does not exist any more. Results found in the on-disk cache have
+// no AST; it is parsed again only when needed for writing.
+func (p *Parser) refreshFile(fset *token.FileSet, path string, cached *cacheEntry) (*cacheEntry, error) {
+	fname, dir := p.src.name(path), p.src.pkgDir(path)
+	src, err := fs.ReadFile(p.src.fsys, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %s: %w", fname, err)
+	}
+
+	hash := sha256.Sum256(src)
+	if cached != nil && cached.hash == hash {
+		return cached, nil
+	}
+
+	var key string
+	if p.cache != nil {
+		key = p.cache.key(fname, dir, hash)
+		if result, ok := p.cache.load(key); ok {
+			return &cacheEntry{hash: hash, result: result}, nil
+		}
+	}
+
+	var lastGood *fileResult
+	if cached != nil {
+		lastGood = cached.result
+	}
+	result, diagnostics := parseFile(fset, fname, dir, src, lastGood)
+	p.logf("Parsed file: %s", fname)
+
+	// Only clean parses are persisted: a broken file's result depends on
+	// what parsed before it, not on its content.
+	if p.cache != nil && result != nil && len(diagnostics) == 0 {
+		if err := p.cache.store(key, result); err != nil {
+			p.logf("Error caching %s: %v", fname, err)
+		}
+	}
+	return &cacheEntry{hash: hash, result: result, diagnostics: diagnostics}, nil
+}
+
+// parseFile parses a single file of directory dir, relative to the root,
+// with parser.AllErrors. On failure it returns lastGood, the previous result
+// for the file (possibly nil), together with the diagnostics.
+func parseFile(fset *token.FileSet, fname, dir string, src []byte, lastGood *fileResult) (result *fileResult, diagnostics []Diagnostic) {
+	defer func() {
+		if r := recover(); r != nil {
+			diagnostics = append(diagnostics, Diagnostic{
+				File:    fname,
+				Message: fmt.Sprintf("internal error: %v", r),
+			})
+			result = lastGood
+		}
+	}()
+
+	f, err := parser.ParseFile(fset, fname, src, parser.AllErrors)
+	if err != nil {
+		return lastGood, toDiagnostics(fname, err)
+	}
+
+	file, edges, functions, methods := getStructsFile(fset, f, fname, PackageID(dir, f.Name.Name))
+	return &fileResult{
+		packageName: f.Name.Name,
+		ast:         f,
+		file:        file,
+		edges:       edges,
+		functions:   functions,
+		methods:     methods,
+	}, nil
+}
+
+// merge builds the global model and the AST map from the cached results.
+func (p *Parser) merge() (*ClientStruct, map[string]*ast.Package) {
+	paths := make([]string, 0, len(p.files))
+	for path := range p.files {
+		paths = append(paths, path)
+	}
+	// Keep the files of one directory together, directories in walk order.
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := pathpkg.Dir(paths[i]), pathpkg.Dir(paths[j])
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	var packages []Package
+	var edges []Edge
+	var globalFunctions []Function
+	var diagnostics []Diagnostic
+	pkgmap := map[string]*ast.Package{}
+
+	for start := 0; start < len(paths); {
+		directory := pathpkg.Dir(paths[start])
+		end := start
+		for end < len(paths) && pathpkg.Dir(paths[end]) == directory {
+			end++
+		}
+
+		dirPackages := map[string]*Package{}
+		dirMethods := map[string][]recvMethod{}
+		var packagenames []string
+		for _, path := range paths[start:end] {
+			entry := p.files[path]
+			diagnostics = append(diagnostics, entry.diagnostics...)
+			result := entry.result
+			if result == nil {
+				continue
+			}
+
+			pkg, ok := dirPackages[result.packageName]
+			if !ok {
+				id := PackageID(p.src.pkgDir(path), result.packageName)
+				pkg = &Package{ID: id, Name: result.packageName, Files: []File{}}
+				dirPackages[result.packageName] = pkg
+				packagenames = append(packagenames, result.packageName)
+				pkgmap[id] = &ast.Package{Name: result.packageName, Files: map[string]*ast.File{}}
+			}
+			file := result.file
+			file.Version = hashVersion(entry.hash)
+			pkg.Files = append(pkg.Files, file)
+			edges = append(edges, copyEdges(result.edges)...)
+			globalFunctions = append(globalFunctions, result.functions...)
+			dirMethods[result.packageName] = append(dirMethods[result.packageName], result.methods...)
+
+			pkgmap[pkg.ID].Files[p.src.name(path)] = result.ast
+		}
+
+		sort.Strings(packagenames)
+		for _, name := range packagenames {
+			pkg := dirPackages[name]
+			for _, m := range dirMethods[name] {
+				attachPackageMethod(pkg, m)
+			}
+			packages = append(packages, *pkg)
+		}
+		start = end
+	}
+
+	// Fill in filenames for edges
+	structFiles := structFileIndex(packages)
+	validedges := []Edge{}
+	for _, edge := range edges {
+		if name := structFiles[edge.To.PackageName+"."+edge.To.StructName]; name != "" {
+			edge.To.FileName = name
+			validedges = append(validedges, edge)
+		}
+	}
+
+	clientStruct := &ClientStruct{
+		Packages:        packages,
+		Edges:           validedges,
+		GlobalFunctions: globalFunctions,
+		Diagnostics:     diagnostics,
+	}
+	SortClientStruct(clientStruct)
+
+	return clientStruct, pkgmap
+}
+
+func toDiagnostics(fname string, err error) []Diagnostic {
+	var list scanner.ErrorList
+	if !errors.As(err, &list) {
+		return []Diagnostic{{File: fname, Message: err.Error()}}
+	}
+
+	diagnostics := make([]Diagnostic, 0, len(list))
+	for _, e := range list {
+		diagnostics = append(diagnostics, Diagnostic{
+			File:    fname,
+			Line:    e.Pos.Line,
+			Column:  e.Pos.Column,
+			Message: e.Msg,
+		})
+	}
+	return diagnostics
+}
+
+// walkGoFiles lists the .go files below root in fsys, skipping .git and
+// node_modules directories.
+func walkGoFiles(ctx context.Context, fsys fs.FS, root string) ([]string, error) {
+	var paths []string
+	err := fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path != root && isExcluded(path) {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && pathpkg.Ext(path) == ".go" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking directory: %w", err)
+	}
+	return paths, nil
+}
+
+// isExcluded reports whether path, relative to the parsed root, lies in a
+// directory that is never parsed.
+func isExcluded(path string) bool {
+	return strings.Contains(path, ".git") || strings.Contains(path, "node_modules")
+}
+
+// attachPackageMethod adds m to its struct in one of the files of pkg. The
+// structs and methods are copied first, as they belong to cached results.
+// A method of a type that is not a struct is dropped.
+func attachPackageMethod(pkg *Package, m recvMethod) {
+	for i := range pkg.Files {
+		structs := pkg.Files[i].Structs
+		for j := range structs {
+			if structs[j].Name != m.Struct {
+				continue
+			}
+			structs = append([]Struct(nil), structs...)
+			structs[j].Methods = append(append([]Method(nil), structs[j].Methods...), m.Method)
+			pkg.Files[i].Structs = structs
+			return
+		}
+	}
+}
+
+// copyEdges returns a copy of edges whose nodes can be modified without
+// touching the cached originals.
+func copyEdges(edges []Edge) []Edge {
+	copied := make([]Edge, 0, len(edges))
+	for _, edge := range edges {
+		from, to := *edge.From, *edge.To
+		copied = append(copied, Edge{From: &from, To: &to})
+	}
+	return copied
+}
+
+// structFileIndex maps "package.Struct" to the file declaring it. Like
+// GetFileName, the first declaration wins.
+func structFileIndex(packages []Package) map[string]string {
+	index := map[string]string{}
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			for _, st := range file.Structs {
+				key := pkg.Name + "." + st.Name
+				if _, ok := index[key]; !ok {
+					index[key] = file.Name
+				}
+			}
+		}
+	}
+	return index
+}
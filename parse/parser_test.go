@@ -0,0 +1,207 @@
+package parse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// benchTree writes a module of packages*files generated files to dir, each
+// with a few structs referring to the previous package, and returns the
+// name of one of the files.
+func benchTree(tb testing.TB, dir string, packages, files int) string {
+	tb.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module bench\n\ngo 1.21\n"), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	var name string
+	for p := 0; p < packages; p++ {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("p%d", p))
+		if err := os.MkdirAll(pkgDir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for f := 0; f < files; f++ {
+			name = filepath.Join(pkgDir, fmt.Sprintf("f%d.go", f))
+			if err := os.WriteFile(name, benchFile(p, f), 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return name
+}
+
+func benchFile(p, f int) []byte {
+	src := fmt.Sprintf("package p%d\n\n", p)
+	if p > 0 {
+		src += fmt.Sprintf("import prev \"bench/p%d\"\n\n", p-1)
+	}
+	for s := 0; s < 3; s++ {
+		src += fmt.Sprintf("// S%d_%d is generated.\ntype S%d_%d struct {\n\tID   int\n\tName string\n\tTags []string\n", f, s, f, s)
+		if p > 0 {
+			src += fmt.Sprintf("\tPrev *prev.S%d_%d\n", f, s)
+		}
+		src += "}\n\n"
+		src += fmt.Sprintf("func (s *S%d_%d) Label(prefix string) (string, error) { return prefix + s.Name, nil }\n\n", f, s)
+	}
+	src += fmt.Sprintf("func Helper%d(n int) int { return n * %d }\n", f, f)
+	return []byte(src)
+}
+
+// BenchmarkParseDir parses a tree of about 4000 files from scratch, on one
+// worker and on GOMAXPROCS workers.
+func BenchmarkParseDir(b *testing.B) {
+	dir := b.TempDir()
+	benchTree(b, dir, 100, 40)
+	workerCounts := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p := NewParser()
+				p.SetWorkers(workers)
+				if _, _, err := p.ParseDir(context.Background(), dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRefresh rebuilds the model of the same tree, with the parser
+// cache warm, after one file changed.
+func BenchmarkRefresh(b *testing.B) {
+	dir := b.TempDir()
+	name := benchTree(b, dir, 100, 40)
+	p := NewParser()
+	if _, _, err := p.ParseDir(context.Background(), dir); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src := append(benchFile(99, 39), fmt.Sprintf("\nvar V%d int\n", i)...)
+		if err := os.WriteFile(name, src, 0644); err != nil {
+			b.Fatal(err)
+		}
+		p.Invalidate(name)
+		if _, _, err := p.Refresh(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestPackageIDs parses packages of the same name in different directories
+// and edits each by the IDs of its model.
+func TestPackageIDs(t *testing.T) {
+	dir, model, p := writeDir(t, map[string]string{
+		"go.mod":                  "module m\n\ngo 1.21\n",
+		"util.go":                 "package m\n\ntype S struct{ R int }\n",
+		"internal/util/u.go":      "package util\n\ntype S struct{ N int }\n",
+		"internal/util/u_test.go": "package util_test\n\ntype S struct{ T int }\n",
+		"cmd/util/u.go":           "package util\n\ntype S struct{ M int }\n",
+		"cmd/x/main.go":           "package main\n\ntype Config struct{ X int }\n\nfunc main() {}\n",
+		"cmd/y/main.go":           "package main\n\ntype Config struct{ Y int }\n\nfunc main() {}\n",
+	})
+	var ids []string
+	for _, pkg := range model.Packages {
+		for _, file := range pkg.Files {
+			for _, st := range file.Structs {
+				ids = append(ids, pkg.ID+" "+st.ID+" "+st.Fields[0].ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	want := []string{
+		". ..S ..S.R",
+		"cmd/util cmd/util.S cmd/util.S.M",
+		"cmd/x cmd/x.Config cmd/x.Config.X",
+		"cmd/y cmd/y.Config cmd/y.Config.Y",
+		"internal/util internal/util.S internal/util.S.N",
+		"internal/util_test internal/util_test.S internal/util_test.S.T",
+	}
+	if strings.Join(ids, "\n") != strings.Join(want, "\n") {
+		t.Errorf("package, struct and field IDs:\n%s\nwant\n%s", strings.Join(ids, "\n"), strings.Join(want, "\n"))
+	}
+
+	// ReadFile gives the IDs the Parser does.
+	file, err := ReadFile(dir, filepath.Join(dir, "cmd", "util", "u.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := file.Structs[0].ID; got != "cmd/util.S" {
+		t.Errorf("ReadFile: struct ID %s, want cmd/util.S", got)
+	}
+
+	_, pkgs, err := p.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := func(edits []FileEdit) string {
+		var names []string
+		for _, e := range edits {
+			rel, _ := filepath.Rel(dir, e.Name)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return strings.Join(names, " ")
+	}
+	ops := []struct {
+		op         Op
+		want, file string
+	}{
+		{Op{Op: "addField", ID: "cmd/util.S", Name: "K", FieldType: "int"}, "cmd/util.S.K", "cmd/util/u.go"},
+		{Op{Op: "deleteField", ID: "internal/util.S.N"}, "", "internal/util/u.go"},
+		{Op{Op: "addStruct", ID: "cmd/y", Name: "T", File: filepath.Join(dir, "cmd", "y", "main.go")}, "cmd/y.T", "cmd/y/main.go"},
+		{Op{Op: "addMethod", ID: "..S", Name: "Get"}, "..S.Get", "util.go"},
+	}
+	for _, test := range ops {
+		edits, id, err := RenderOp(context.Background(), pkgs, test.op)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.op.Op, test.op.ID, err)
+			continue
+		}
+		if id != test.want || edited(edits) != test.file {
+			t.Errorf("%s %s: got %q editing %s, want %q editing %s", test.op.Op, test.op.ID, id, edited(edits), test.want, test.file)
+		}
+	}
+	if _, _, err := RenderOp(context.Background(), pkgs, Op{Op: "deleteStruct", ID: "util.S"}); err == nil || !strings.Contains(err.Error(), "unknown package util") {
+		t.Errorf("deleteStruct util.S: got %v, want an unknown package", err)
+	}
+
+	// Writing the model back finds each package by its ID.
+	got := renderModel(t, dir, p, func(model *ClientStruct) {
+		for i := range model.Packages {
+			if model.Packages[i].ID == "cmd/util" {
+				model.Packages[i].Files[0].Structs[0].Fields[0].Name = "Size"
+			}
+		}
+	})
+	if len(got) != 1 || !strings.Contains(got["cmd/util/u.go"], "Size int") {
+		t.Errorf("renaming the field of cmd/util.S rendered %v", got)
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	edits, err := RenderRename(context.Background(), pkgs, "internal/util.S", "Store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := edited(edits); got != "internal/util/u.go" {
+		t.Errorf("renaming internal/util.S edited %s", got)
+	}
+	// A new package may share its name with others.
+	edits, id, err := RenderMove(context.Background(), pkgs, "cmd/util.S", filepath.Join(dir, "pkg", "util", "s.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "pkg/util.S" || edited(edits) != "cmd/util/u.go pkg/util/s.go" {
+		t.Errorf("moving cmd/util.S: got %s editing %s", id, edited(edits))
+	}
+}
@@ -0,0 +1,155 @@
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// newFilePath validates the name of a file the model adds to the package
+// packagename, of ID pkgID in pkgs unless the package is new, and returns the
+// path to create it at. A name without a directory goes in the directory of
+// the package, or in a directory named after the package in root if the
+// package is new as well; other names are relative to root, see
+// ResolvePath. New files must lie in a module and in the directory of their
+// package; newDirs remembers the directories chosen for new packages, by
+// name, so that all files of one land together.
+func newFilePath(pkgs map[string]*ast.Package, root, pkgID, packagename, name string, newDirs map[string]string) (string, error) {
+	if strings.HasSuffix(name, "_test.go") {
+		return "", fmt.Errorf("%s is a test file", name)
+	}
+	dir := newDirs[packagename]
+	if astpkg, ok := pkgs[pkgID]; ok {
+		for fname := range astpkg.Files {
+			dir = filepath.Dir(fname)
+			break
+		}
+	} else if !token.IsIdentifier(packagename) {
+		return "", fmt.Errorf("invalid package name %q", packagename)
+	}
+	known := dir != ""
+	if filepath.Dir(name) == "." {
+		if dir == "" {
+			dir = filepath.Join(root, packagename)
+		}
+		name = filepath.Join(dir, name)
+	} else {
+		var err error
+		if name, err = ResolvePath(root, name); err != nil {
+			return "", err
+		}
+	}
+	if err := checkPath(root, name); err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if known {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		if filepath.Dir(abs) != absDir {
+			return "", fmt.Errorf("%s is not in %s, the directory of package %s", name, dir, packagename)
+		}
+	} else {
+		if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(abs), "*.go")); len(matches) > 0 {
+			return "", fmt.Errorf("%s already holds a package other than %s", filepath.Dir(name), packagename)
+		}
+		if !inModule(filepath.Dir(abs)) {
+			return "", fmt.Errorf("%s is not inside a Go module", filepath.Dir(name))
+		}
+		newDirs[packagename] = filepath.Dir(name)
+	}
+	if _, err := os.Stat(name); err == nil {
+		return "", fmt.Errorf("%s already exists", name)
+	}
+	return name, nil
+}
+
+// ResolvePath returns the path on disk of name, a slash-separated path
+// relative to root as the client sends it, after checking it with
+// checkPath. Absolute paths are refused.
+func ResolvePath(root, name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) || path.IsAbs(name) {
+		return "", fmt.Errorf("invalid path %q: paths are relative to %s", name, root)
+	}
+	resolved := filepath.Join(root, filepath.FromSlash(name))
+	if err := checkPath(root, resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// checkPath checks that name, a path on disk that need not exist yet, is a
+// Go source file inside root, also once symbolic links are followed.
+func checkPath(root, name string) error {
+	if filepath.Ext(name) != ".go" {
+		return fmt.Errorf("%s is not a Go source file", name)
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if !inside(absRoot, abs) {
+		return fmt.Errorf("%s is outside %s", name, root)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return err
+	}
+	existing := abs
+	if _, err := os.Lstat(abs); err != nil {
+		existing = existingDir(filepath.Dir(abs))
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !inside(realRoot, real) {
+		return fmt.Errorf("%s leads outside %s through a symbolic link", name, root)
+	}
+	return nil
+}
+
+// inside reports whether the absolute path name is root or lies below it.
+func inside(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// inModule reports whether a go.mod file is in dir or one of its parents.
+func inModule(dir string) bool {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// existingDir returns dir, or its closest parent that exists if dir is yet
+// to be created.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,139 @@
+package parse
+
+import (
+	"go/ast"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pathsRoot creates a module with package a in a/ and, next to it, a
+// directory outside the root that symbolic links of the root point to.
+func pathsRoot(t *testing.T) (root, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root, outside = filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for name, content := range map[string]string{
+		"root/go.mod":    "module m\n",
+		"root/a/a.go":    "package a\n",
+		"outside/x.go":   "package x\n",
+		"nomod/b/b.go":   "package b\n",
+		"root/a/doc.txt": "",
+	} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link":    outside,
+		"ln.go":   filepath.Join(outside, "x.go"),
+		"a/up.go": filepath.Join(outside, "x.go"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Skip("symbolic links not supported:", err)
+		}
+	}
+	return root, outside
+}
+
+// checkResult compares a resolved path, relative to root, or an error with
+// what a test wants: a path, or "error: " and part of the message.
+func checkResult(t *testing.T, what, root, got string, err error, want string) {
+	t.Helper()
+	if wantErr, ok := strings.CutPrefix(want, "error: "); ok {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got %q, %v, want an error containing %q", what, got, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", what, err)
+		return
+	}
+	if rel, _ := filepath.Rel(root, got); filepath.ToSlash(rel) != want {
+		t.Errorf("%s: got %s, want %s", what, rel, want)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root, outside := pathsRoot(t)
+	tests := []struct {
+		name, want string
+	}{
+		{"a/a.go", "a/a.go"},
+		{"a/new.go", "a/new.go"},
+		{"new/deep/n.go", "new/deep/n.go"},
+		{"a/../b.go", "b.go"},
+		// A name starting with two dots is not a parent directory.
+		{"..b.go", "..b.go"},
+		{"", "error: invalid path"},
+		{"../x.go", "error: is outside"},
+		{"a/../../x.go", "error: is outside"},
+		{"../root/../outside/x.go", "error: is outside"},
+		{"/etc/x.go", "error: paths are relative to"},
+		{filepath.Join(outside, "x.go"), "error: paths are relative to"},
+		{"link/x.go", "error: through a symbolic link"},
+		{"link/new/n.go", "error: through a symbolic link"},
+		{"ln.go", "error: through a symbolic link"},
+		{"a/up.go", "error: through a symbolic link"},
+		{"a/doc.txt", "error: not a Go source file"},
+		{"a/a.go.orig", "error: not a Go source file"},
+		{"a", "error: not a Go source file"},
+	}
+	for _, test := range tests {
+		got, err := ResolvePath(root, test.name)
+		checkResult(t, "ResolvePath("+test.name+")", root, got, err, test.want)
+	}
+}
+
+func TestNewFilePath(t *testing.T) {
+	root, _ := pathsRoot(t)
+	pkgs := map[string]*ast.Package{
+		"a": {Name: "a", Files: map[string]*ast.File{filepath.Join(root, "a", "a.go"): nil}},
+	}
+	tests := []struct {
+		pkg, name, want string
+	}{
+		{"a", "b.go", "a/b.go"},
+		{"a", "a/b.go", "a/b.go"},
+		{"a", "a.go", "error: already exists"},
+		{"a", "a_test.go", "error: is a test file"},
+		{"a", "a/b_test.go", "error: is a test file"},
+		{"a", "b.txt", "error: not a Go source file"},
+		{"a", "sub/b.go", "error: is not in"},
+		{"a", "b/b.go", "error: is not in"},
+		{"a", "../b.go", "error: is outside"},
+		{"a", "/tmp/b.go", "error: paths are relative to"},
+		{"a", "link/b.go", "error: through a symbolic link"},
+		{"fresh", "f.go", "fresh/f.go"},
+		{"fresh", "pkgs/fresh/f.go", "pkgs/fresh/f.go"},
+		{"fresh", "a/f.go", "error: already holds a package other than fresh"},
+		{"fresh", "link/f.go", "error: through a symbolic link"},
+		{"fresh", "../nomod/f.go", "error: is outside"},
+		{"9lives", "f.go", "error: invalid package name"},
+	}
+	for _, test := range tests {
+		got, err := newFilePath(pkgs, root, test.pkg, test.pkg, test.name, map[string]string{})
+		checkResult(t, "newFilePath("+test.pkg+", "+test.name+")", root, got, err, test.want)
+	}
+
+	// All files of a new package land in the directory of the first one.
+	newDirs := map[string]string{}
+	if _, err := newFilePath(pkgs, root, "fresh", "fresh", "x/f.go", newDirs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := newFilePath(pkgs, root, "fresh", "fresh", "g.go", newDirs)
+	checkResult(t, "second file of a new package", root, got, err, "x/g.go")
+	got, err = newFilePath(pkgs, root, "fresh", "fresh", "y/g.go", newDirs)
+	checkResult(t, "second file of a new package elsewhere", root, got, err, "error: is not in")
+
+	// A new package needs a module.
+	nomod := filepath.Join(filepath.Dir(root), "nomod")
+	_, err = newFilePath(pkgs, nomod, "fresh", "fresh", "f.go", map[string]string{})
+	checkResult(t, "new package outside a module", nomod, "", err, "error: is not inside a Go module")
+}
@@ -0,0 +1,282 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// RenderRename computes the edits that rename a struct, or a field or
+// method of one, given by its entity ID, together with every reference to it
+// in the packages of pkgs and their tests: composite literals, selectors,
+// method values and calls, and the fields that embed a renamed type along
+// with their own references. A name the package, or the struct, already
+// declares is refused. Methods of other types that implement the same
+// interface method are not renamed; the type check of the edits reports
+// what that breaks.
+func RenderRename(ctx context.Context, pkgs map[string]*ast.Package, id, name string) ([]FileEdit, error) {
+	if !token.IsIdentifier(name) {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	parts, err := splitID(pkgs, id, 3, 2)
+	if err != nil {
+		return nil, err
+	}
+	tp, home, err := loadTyped(ctx, pkgs, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	fset := tp.fset
+
+	target, err := lookupEntity(home.Types, parts)
+	if err != nil {
+		return nil, err
+	}
+	if target.Name() == name {
+		return nil, nil
+	}
+	if len(parts) == 2 {
+		if home.Types.Scope().Lookup(name) != nil {
+			return nil, fmt.Errorf("package %s already declares %s", home.Name, name)
+		}
+	} else if _, err := lookupEntity(home.Types, []string{parts[0], parts[1], name}); err == nil {
+		return nil, fmt.Errorf("struct %s already has a field or method %s", parts[1], name)
+	}
+
+	// Test variants type-check the same files again, with objects of
+	// their own, so objects are matched by where they are declared.
+	key := func(obj types.Object) token.Position {
+		return fset.Position(obj.Pos())
+	}
+	targets := map[token.Position]bool{key(target): true}
+	if _, isType := target.(*types.TypeName); isType {
+		for _, pkg := range tp.loaded {
+			if pkg.TypesInfo == nil {
+				continue
+			}
+			for _, obj := range pkg.TypesInfo.Defs {
+				if v, ok := obj.(*types.Var); ok && v.Embedded() && embeds(v.Type(), key, key(target)) {
+					targets[key(v)] = true
+				}
+			}
+		}
+	}
+
+	offsets := map[string]map[int]bool{}
+	mark := func(ident *ast.Ident, obj types.Object) {
+		if obj == nil || !targets[key(obj)] {
+			return
+		}
+		pos := fset.Position(ident.Pos())
+		if !tp.files[pos.Filename] {
+			return
+		}
+		if offsets[pos.Filename] == nil {
+			offsets[pos.Filename] = map[int]bool{}
+		}
+		offsets[pos.Filename][pos.Offset] = true
+	}
+	for _, pkg := range tp.loaded {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		for ident, obj := range pkg.TypesInfo.Defs {
+			mark(ident, obj)
+		}
+		for ident, obj := range pkg.TypesInfo.Uses {
+			mark(ident, obj)
+		}
+	}
+
+	names := make([]string, 0, len(offsets))
+	for fname := range offsets {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+	var edits []FileEdit
+	for _, fname := range names {
+		old, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		src, err := renameAt(old, offsets[fname], target.Name(), name)
+		if err != nil {
+			return nil, fmt.Errorf("error renaming in %s: %w", fname, err)
+		}
+		edits = append(edits, FileEdit{Name: modelName(pkgs, fname), Old: old, New: src})
+	}
+	return edits, nil
+}
+
+// typedPackages are the packages of a diagram loaded with type information,
+// along with their tests and their module.
+type typedPackages struct {
+	fset   *token.FileSet
+	loaded []*packages.Package
+	// files holds the absolute names of the files of the diagram.
+	files map[string]bool
+}
+
+// loadTyped loads the packages of pkgs and returns them with the one of ID
+// id, as built without its tests.
+func loadTyped(ctx context.Context, pkgs map[string]*ast.Package, id string) (*typedPackages, *packages.Package, error) {
+	astpkg, ok := pkgs[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown package %s", id)
+	}
+
+	tp := &typedPackages{files: map[string]bool{}}
+	dirs := map[string]bool{}
+	for _, p := range pkgs {
+		for fname := range p.Files {
+			abs, err := filepath.Abs(fname)
+			if err != nil {
+				return nil, nil, err
+			}
+			tp.files[abs] = true
+			dirs[filepath.Dir(abs)] = true
+		}
+	}
+	// Any file of the package locates it among the loaded ones.
+	var home string
+	for fname := range astpkg.Files {
+		abs, err := filepath.Abs(fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if home == "" || abs < home {
+			home = abs
+		}
+	}
+
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:     filepath.Dir(home),
+		Tests:   true,
+	}
+	loaded, err := packages.Load(cfg, sortedKeys(dirs)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading packages: %w", err)
+	}
+	if len(loaded) == 0 {
+		return nil, nil, fmt.Errorf("no packages found for %s", id)
+	}
+	tp.fset = loaded[0].Fset
+	tp.loaded = loaded
+
+	if pkg := tp.typedPackage(astpkg); pkg != nil {
+		return tp, pkg, nil
+	}
+	return nil, nil, fmt.Errorf("package %s does not type-check", id)
+}
+
+// typedPackage returns the loaded package built from the files of astpkg
+// without its tests, or nil if it does not type-check.
+func (tp *typedPackages) typedPackage(astpkg *ast.Package) *packages.Package {
+	for fname := range astpkg.Files {
+		abs, err := filepath.Abs(fname)
+		if err != nil {
+			continue
+		}
+		for _, pkg := range tp.loaded {
+			if pkg.Types != nil && pkg.ID == pkg.PkgPath && pkg.Name == astpkg.Name && containsFile(pkg.GoFiles, abs) {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEntity finds the object of an entity ID in a type-checked package.
+func lookupEntity(pkg *types.Package, parts []string) (types.Object, error) {
+	obj, ok := pkg.Scope().Lookup(parts[1]).(*types.TypeName)
+	if !ok {
+		return nil, fmt.Errorf("unknown struct %s", EntityID(parts[:2]...))
+	}
+	st, ok := obj.Type().Underlying().(*types.Struct)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a struct", EntityID(parts[:2]...))
+	}
+	if len(parts) == 2 {
+		return obj, nil
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if st.Field(i).Name() == parts[2] {
+			return st.Field(i), nil
+		}
+	}
+	if named, ok := obj.Type().(*types.Named); ok {
+		for i := 0; i < named.NumMethods(); i++ {
+			if named.Method(i).Name() == parts[2] {
+				return named.Method(i), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("struct %s has no field or method %s", parts[1], parts[2])
+}
+
+// embeds reports whether t, the type of an embedded field, is the type
+// declared at target or a pointer to it.
+func embeds(t types.Type, key func(types.Object) token.Position, target token.Position) bool {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	return ok && key(named.Origin().Obj()) == target
+}
+
+// renameAt replaces the identifier old at each of offsets in src with name
+// and reformats the result, since longer or shorter names change the
+// alignment of fields and comments.
+func renameAt(src []byte, offsets map[int]bool, old, name string) ([]byte, error) {
+	positions := make([]int, 0, len(offsets))
+	for offset := range offsets {
+		positions = append(positions, offset)
+	}
+	sort.Ints(positions)
+
+	var buf bytes.Buffer
+	last := 0
+	for _, offset := range positions {
+		if !bytes.HasPrefix(src[offset:], []byte(old)) {
+			return nil, fmt.Errorf("offset %d is not %s", offset, old)
+		}
+		buf.Write(src[last:offset])
+		buf.WriteString(name)
+		last = offset + len(old)
+	}
+	buf.Write(src[last:])
+	return format.Source(buf.Bytes())
+}
+
+func containsFile(files []string, name string) bool {
+	for _, f := range files {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// modelName returns the name pkgs knows the file abs by, which may be
+// relative.
+func modelName(pkgs map[string]*ast.Package, abs string) string {
+	for _, p := range pkgs {
+		for fname := range p.Files {
+			if a, err := filepath.Abs(fname); err == nil && a == abs {
+				return fname
+			}
+		}
+	}
+	return abs
+}
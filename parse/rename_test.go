@@ -0,0 +1,159 @@
+package parse
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// renameModule declares Item, which embeds Base, in package a, and uses
+// both in the tests of a, in package b and in the external tests of b.
+var renameModule = map[string]string{
+	"go.mod": "module m\n\ngo 1.21\n",
+	"a/a.go": `package a
+
+// Base is embedded.
+type Base struct{ ID int }
+
+func (b *Base) Describe() string { return "base" }
+
+// Item has a field, a method and an embedded Base.
+type Item struct {
+	Base
+	Name string
+}
+
+func (i *Item) Label() string { return i.Name + i.Describe() }
+
+func New() *Item { return &Item{Base: Base{ID: 1}, Name: "x"} }
+`,
+	"a/a_test.go": `package a
+
+import "testing"
+
+func TestItem(t *testing.T) {
+	it := Item{Name: "n"}
+	_ = it.Label()
+	_ = it.Base.ID
+}
+`,
+	"b/b.go": `package b
+
+import "m/a"
+
+func Use(it *a.Item) string {
+	var x a.Item = a.Item{Name: it.Name, Base: a.Base{ID: it.ID}}
+	f := it.Label
+	return x.Name + f() + it.Base.Describe()
+}
+`,
+	"b/b_test.go": `package b_test
+
+import (
+	"testing"
+
+	"m/a"
+)
+
+func TestUse(t *testing.T) { _ = a.Item{Name: "t"}.Name }
+`,
+}
+
+func TestRenderRename(t *testing.T) {
+	tests := []struct {
+		id, name string
+		// want holds, by file, text it must contain after the rename, or
+		// must not if prefixed with "!".
+		want map[string][]string
+	}{
+		{
+			id:   "a.Item",
+			name: "Entry",
+			want: map[string][]string{
+				"a/a.go":      {"type Entry struct", "func (i *Entry) Label()", "return &Entry{", "!Item{"},
+				"a/a_test.go": {"it := Entry{"},
+				"b/b.go":      {"func Use(it *a.Entry)", "var x a.Entry = a.Entry{", "!a.Item"},
+				"b/b_test.go": {"_ = a.Entry{"},
+			},
+		},
+		{
+			id:   "a.Item.Name",
+			name: "Title",
+			want: map[string][]string{
+				"a/a.go":      {"\tTitle string", "return i.Title +", `Title: "x"`, "!Name"},
+				"a/a_test.go": {`Item{Title: "n"}`},
+				"b/b.go":      {"a.Item{Title: it.Title,", "return x.Title +", "!Name"},
+				"b/b_test.go": {`_ = a.Item{Title: "t"}.Title`},
+			},
+		},
+		{
+			id:   "a.Item.Label",
+			name: "Caption",
+			want: map[string][]string{
+				"a/a.go":      {"func (i *Item) Caption() string"},
+				"a/a_test.go": {"_ = it.Caption()"},
+				"b/b.go":      {"f := it.Caption", "!Label"},
+			},
+		},
+		{
+			// Renaming an embedded type renames the field and its uses.
+			id:   "a.Base",
+			name: "Core",
+			want: map[string][]string{
+				"a/a.go":      {"type Core struct", "\tCore\n", "func (b *Core) Describe()", "&Item{Core: Core{ID: 1}", "!Base{", "!\tBase\n"},
+				"a/a_test.go": {"_ = it.Core.ID"},
+				"b/b.go":      {"Core: a.Core{ID: it.ID}", "it.Core.Describe()", "!Base"},
+			},
+		},
+	}
+	for _, test := range tests {
+		dir, pkgs := writeModule(t, renameModule)
+		edits, err := RenderRename(context.Background(), pkgs, test.id, test.name)
+		if err != nil {
+			t.Errorf("rename %s to %s: %v", test.id, test.name, err)
+			continue
+		}
+		got := applyEdits(t, dir, edits)
+		if len(got) != len(test.want) {
+			t.Errorf("rename %s to %s: edited %d files, want %d", test.id, test.name, len(got), len(test.want))
+		}
+		for file, wants := range test.want {
+			for _, want := range wants {
+				if text, ok := strings.CutPrefix(want, "!"); ok {
+					if strings.Contains(got[file], text) {
+						t.Errorf("rename %s to %s: %s still has %q:\n%s", test.id, test.name, file, text, got[file])
+					}
+				} else if !strings.Contains(got[file], want) {
+					t.Errorf("rename %s to %s: %s lacks %q:\n%s", test.id, test.name, file, want, got[file])
+				}
+			}
+		}
+	}
+}
+
+func TestRenderRenameConflicts(t *testing.T) {
+	_, pkgs := writeModule(t, renameModule)
+	tests := []struct {
+		id, name, want string
+	}{
+		{"a.Item", "Base", "package a already declares Base"},
+		{"a.Item", "New", "package a already declares New"},
+		{"a.Item.Name", "Base", "struct Item already has a field or method Base"},
+		{"a.Item.Name", "Label", "struct Item already has a field or method Label"},
+		{"a.Item.Label", "Name", "struct Item already has a field or method Name"},
+		{"a.Item.Name", "2x", "invalid name"},
+		{"a.Nope", "X", "unknown struct a.Nope"},
+		{"z.Item", "X", "unknown package z"},
+	}
+	for _, test := range tests {
+		_, err := RenderRename(context.Background(), pkgs, test.id, test.name)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("rename %s to %s: got %v, want %q", test.id, test.name, err, test.want)
+		}
+	}
+
+	// Keeping the name edits nothing.
+	if edits, err := RenderRename(context.Background(), pkgs, "a.Item.Name", "Name"); err != nil || len(edits) != 0 {
+		t.Errorf("rename to the same name: %v, %v", edits, err)
+	}
+}
@@ -0,0 +1,227 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// UnifiedDiff returns the changes from old to new in unified diff format,
+// as diff -u and git diff print them, or "" when the contents are equal.
+func UnifiedDiff(oldName, newName string, old, new []byte) string {
+	if bytes.Equal(old, new) {
+		return ""
+	}
+	a, b := splitLines(old), splitLines(new)
+	ops := diffLines(a, b)
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks(ops) {
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(h.oldStart, h.oldLines), hunkRange(h.newStart, h.newLines))
+		for _, op := range ops[h.first:h.last] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+// splitLines splits text into lines that keep their newline; only the last
+// line can lack one.
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, string(text))
+			break
+		}
+		lines = append(lines, string(text[:i+1]))
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// diffOp is one line of an edit script: ' ' kept, '-' deleted, '+' inserted.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines computes a shortest edit script with Myers' algorithm. The
+// common prefix and suffix are split off first, as most edits are small.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func myers(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+2)
+	// trace[d] holds the furthest x reached on each diagonal k in -d..d.
+	var trace [][]int
+
+search:
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				break search
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	// Walk the trace back from (n, m) to (0, 0).
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(trace, d-1, k-1) < at(trace, d-1, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(trace, d-1, prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// at returns the furthest x on diagonal k after round d of myers; before
+// the first round every diagonal starts at 0.
+func at(trace [][]int, d, k int) int {
+	if d < 0 {
+		return 0
+	}
+	return trace[d][k+d]
+}
+
+type hunk struct {
+	first, last        int // range of ops
+	oldStart, oldLines int
+	newStart, newLines int
+}
+
+// hunks groups the changes of an edit script with diffContext lines of
+// context, merging groups whose context would overlap.
+func hunks(ops []diffOp) []hunk {
+	var result []hunk
+	oldLine, newLine := 1, 1
+	lineAt := make([][2]int, len(ops)+1)
+	for i, op := range ops {
+		lineAt[i] = [2]int{oldLine, newLine}
+		if op.kind != '+' {
+			oldLine++
+		}
+		if op.kind != '-' {
+			newLine++
+		}
+	}
+	lineAt[len(ops)] = [2]int{oldLine, newLine}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		first := i - diffContext
+		if first < 0 {
+			first = 0
+		}
+		// Extend over changes separated by at most 2*diffContext kept lines.
+		last := i
+		for last < len(ops) {
+			if ops[last].kind != ' ' {
+				last++
+				continue
+			}
+			next := last
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-last > 2*diffContext {
+				break
+			}
+			last = next
+		}
+		end := last + diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		h := hunk{first: first, last: end, oldStart: lineAt[first][0], newStart: lineAt[first][1]}
+		h.oldLines = lineAt[end][0] - h.oldStart
+		h.newLines = lineAt[end][1] - h.newStart
+		result = append(result, h)
+		i = end
+	}
+	return result
+}
+
+// hunkRange formats a hunk header range; an empty range names the line
+// before it, as diff -u does.
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		start--
+	}
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
@@ -0,0 +1,236 @@
+package parse
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{name: "equal", old: "a\nb\n", new: "a\nb\n", want: ""},
+		{
+			name: "change in the middle",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			new:  "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: "--- a/f\n+++ b/f\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "created file",
+			old:  "",
+			new:  "package p\n",
+			want: "--- a/f\n+++ b/f\n@@ -0,0 +1 @@\n+package p\n",
+		},
+		{
+			name: "removed file",
+			old:  "a\nb\n",
+			new:  "",
+			want: "--- a/f\n+++ b/f\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "no newline at end",
+			old:  "a\nb",
+			new:  "a\nb\n",
+			want: "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "two hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\nsixteen\n",
+			want: "--- a/f\n+++ b/f\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -13,4 +13,4 @@\n 13\n 14\n 15\n-16\n+sixteen\n",
+		},
+		{
+			name: "hunks merged when context overlaps",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\neight\n",
+			want: "--- a/f\n+++ b/f\n@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+	for _, test := range tests {
+		if got := UnifiedDiff("a/f", "b/f", []byte(test.old), []byte(test.new)); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+// TestUnifiedDiffRandom checks on random edits that the diff turns old into
+// new and that its edit script is a shortest one.
+func TestUnifiedDiffRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomText := func() []string {
+		lines := make([]string, rng.Intn(40))
+		for i := range lines {
+			lines[i] = strconv.Itoa(rng.Intn(6)) + "\n"
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomText(), randomText()
+		if i%3 == 0 && len(b) > 0 {
+			b[len(b)-1] = strings.TrimSuffix(b[len(b)-1], "\n")
+		}
+		old, new := strings.Join(a, ""), strings.Join(b, "")
+		diff := UnifiedDiff("a/f", "b/f", []byte(old), []byte(new))
+		got, changes, err := applyUnified(old, diff)
+		if err != nil {
+			t.Fatalf("case %d: %v\n%s", i, err, diff)
+		}
+		if got != new {
+			t.Fatalf("case %d: patched old is %q, want %q\n%s", i, got, new, diff)
+		}
+		if want := len(a) + len(b) - 2*lcs(a, b); changes != want {
+			t.Fatalf("case %d: %d changed lines, a shortest script has %d\n%s", i, changes, want, diff)
+		}
+	}
+}
+
+// TestUnifiedDiffPatch feeds diffs to patch(1), which must accept them.
+func TestUnifiedDiffPatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch not installed")
+	}
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		var a, b []string
+		for j := 0; j < 60; j++ {
+			line := fmt.Sprintf("line %d\n", j)
+			if rng.Intn(8) != 0 {
+				a = append(a, line)
+			}
+			if rng.Intn(8) != 0 {
+				b = append(b, line)
+			} else {
+				b = append(b, "new "+line)
+			}
+		}
+		old, new := strings.Join(a, ""), strings.TrimSuffix(strings.Join(b, ""), "\n")
+		name := filepath.Join(dir, "f")
+		if err := os.WriteFile(name, []byte(old), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("patch", "-s", "-p1", "-d", dir)
+		cmd.Stdin = strings.NewReader(UnifiedDiff("a/f", "b/f", []byte(old), []byte(new)))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("case %d: patch: %v\n%s", i, err, out)
+		}
+		if got, err := os.ReadFile(name); err != nil || string(got) != new {
+			t.Fatalf("case %d: patch produced %q, want %q", i, got, new)
+		}
+	}
+}
+
+// applyUnified applies a diff made by UnifiedDiff to old, checking the hunk
+// headers, and returns the result and the number of lines it changes.
+func applyUnified(old, diff string) (string, int, error) {
+	if diff == "" {
+		return old, 0, nil
+	}
+	a := splitLines([]byte(old))
+	lines := strings.SplitAfter(diff, "\n")
+	if len(lines) < 2 || lines[0] != "--- a/f\n" || lines[1] != "+++ b/f\n" {
+		return "", 0, fmt.Errorf("bad file header")
+	}
+	lines = lines[2 : len(lines)-1]
+
+	var out []string
+	pos, changes := 0, 0
+	for len(lines) > 0 {
+		fields := strings.Fields(lines[0])
+		if len(fields) != 4 || fields[0] != "@@" || fields[3] != "@@" {
+			return "", 0, fmt.Errorf("bad hunk header %q", lines[0])
+		}
+		oldStart, oldLines, err1 := parseRange(strings.TrimPrefix(fields[1], "-"))
+		newStart, newLines, err2 := parseRange(strings.TrimPrefix(fields[2], "+"))
+		if err1 != nil || err2 != nil {
+			return "", 0, fmt.Errorf("bad hunk header %q", lines[0])
+		}
+		// An empty range names the line before it.
+		if oldLines == 0 {
+			oldStart++
+		}
+		if newLines == 0 {
+			newStart++
+		}
+		if oldStart-1 < pos || newStart-1 != len(out)+(oldStart-1-pos) {
+			return "", 0, fmt.Errorf("hunk %q out of place", lines[0])
+		}
+		out = append(out, a[pos:oldStart-1]...)
+		pos = oldStart - 1
+		lines = lines[1:]
+
+		gotOld, gotNew := 0, 0
+		for len(lines) > 0 && !strings.HasPrefix(lines[0], "@@") {
+			line := lines[0]
+			lines = lines[1:]
+			if len(lines) > 0 && lines[0] == "\\ No newline at end of file\n" {
+				line = strings.TrimSuffix(line, "\n")
+				lines = lines[1:]
+			}
+			switch line[0] {
+			case ' ', '-':
+				if pos >= len(a) || a[pos] != line[1:] {
+					return "", 0, fmt.Errorf("line %d of old does not match %q", pos+1, line)
+				}
+				pos++
+				gotOld++
+				if line[0] == ' ' {
+					out = append(out, line[1:])
+					gotNew++
+				} else {
+					changes++
+				}
+			case '+':
+				out = append(out, line[1:])
+				gotNew++
+				changes++
+			default:
+				return "", 0, fmt.Errorf("bad line %q", line)
+			}
+		}
+		if gotOld != oldLines || gotNew != newLines {
+			return "", 0, fmt.Errorf("hunk has %d,%d lines, header says %d,%d", gotOld, gotNew, oldLines, newLines)
+		}
+	}
+	out = append(out, a[pos:]...)
+	return strings.Join(out, ""), changes, nil
+}
+
+// parseRange parses a hunk header range, "start,lines" or "start" for a
+// single line.
+func parseRange(r string) (start, lines int, err error) {
+	startText, linesText, ok := strings.Cut(r, ",")
+	if start, err = strconv.Atoi(startText); err != nil || !ok {
+		return start, 1, err
+	}
+	lines, err = strconv.Atoi(linesText)
+	return start, lines, err
+}
+
+// lcs returns the length of the longest common subsequence of a and b.
+func lcs(a, b []string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,512 @@
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// clientFileToAST applies the structs of clientfile to f in place. It
+// reports whether f changed, and returns the declarations of new structs and
+// methods, which the caller appends to the formatted file. Only what the model describes is
+// touched: struct names, named fields and the signatures of methods declared
+// in the same file. Imports, interfaces, functions, method bodies, embedded
+// fields, tags and comments are kept.
+//
+// Structs, fields and methods are matched by name. A client entry left
+// over is a rename if its ID names an original left over, as the IDs the
+// model was sent with do; see idName. Remaining originals are deleted,
+// remaining client entries are added. A nil parameter or result
+// list in the model leaves the method's own list alone.
+func clientFileToAST(fset *token.FileSet, clientfile File, f *ast.File) (bool, []ast.Decl, error) {
+	var specs []*ast.TypeSpec
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			if ts, ok := spec.(*ast.TypeSpec); ok {
+				if _, isStruct := ts.Type.(*ast.StructType); isStruct {
+					specs = append(specs, ts)
+				}
+			}
+		}
+	}
+
+	names := make([]string, len(specs))
+	for i, ts := range specs {
+		names[i] = ts.Name.Name
+	}
+	clientNames := make([]string, len(clientfile.Structs))
+	clientIDs := make([]string, len(clientfile.Structs))
+	for i, st := range clientfile.Structs {
+		clientNames[i], clientIDs[i] = st.Name, st.ID
+	}
+	pairs, removed, added := matchNames(names, clientNames, clientIDs)
+
+	changed := false
+	var newDecls []ast.Decl
+	for _, pair := range pairs {
+		ts := specs[pair[0]]
+		clientstruct := clientfile.Structs[pair[1]]
+		methods := methodDecls(f, ts.Name.Name)
+
+		if ts.Name.Name != clientstruct.Name {
+			for _, decl := range methods {
+				renameReceiver(decl.Recv.List[0].Type, clientstruct.Name)
+			}
+			ts.Name.Name = clientstruct.Name
+			changed = true
+		}
+
+		fieldsChanged, err := applyFields(fset, ts.Type.(*ast.StructType), clientstruct.Fields)
+		if err != nil {
+			return false, nil, fmt.Errorf("struct %s: %w", clientstruct.Name, err)
+		}
+		methodsChanged, stubs, err := applyMethods(f, clientstruct, methods)
+		if err != nil {
+			return false, nil, fmt.Errorf("struct %s: %w", clientstruct.Name, err)
+		}
+		changed = changed || fieldsChanged || methodsChanged
+		newDecls = append(newDecls, stubs...)
+	}
+
+	for _, i := range removed {
+		removeDecls(f, methodDecls(f, specs[i].Name.Name))
+		removeTypeSpec(f, specs[i])
+		changed = true
+	}
+
+	for _, i := range added {
+		clientstruct := clientfile.Structs[i]
+		st := &ast.StructType{Fields: &ast.FieldList{}}
+		if _, err := applyFields(fset, st, clientstruct.Fields); err != nil {
+			return false, nil, fmt.Errorf("struct %s: %w", clientstruct.Name, err)
+		}
+		newDecls = append(newDecls, &ast.GenDecl{
+			Tok:   token.TYPE,
+			Specs: []ast.Spec{&ast.TypeSpec{Name: ast.NewIdent(clientstruct.Name), Type: st}},
+		})
+		_, stubs, err := applyMethods(f, clientstruct, nil)
+		if err != nil {
+			return false, nil, fmt.Errorf("struct %s: %w", clientstruct.Name, err)
+		}
+		newDecls = append(newDecls, stubs...)
+	}
+
+	return changed, newDecls, nil
+}
+
+// matchNames pairs the indexes of old and new names: equal names first,
+// then the new names whose ID, if any, names a leftover old one. It returns
+// the pairs and the indexes left unpaired on each side.
+func matchNames(oldNames, newNames, newIDs []string) (pairs [][2]int, removed, added []int) {
+	newIndex := map[string]int{}
+	for j, name := range newNames {
+		if _, ok := newIndex[name]; !ok {
+			newIndex[name] = j
+		}
+	}
+	usedOld := make([]bool, len(oldNames))
+	usedNew := make([]bool, len(newNames))
+	for i, name := range oldNames {
+		if j, ok := newIndex[name]; ok && !usedNew[j] {
+			pairs = append(pairs, [2]int{i, j})
+			usedOld[i], usedNew[j] = true, true
+		}
+	}
+
+	oldIndex := map[string]int{}
+	for i, name := range oldNames {
+		if _, ok := oldIndex[name]; !ok && !usedOld[i] {
+			oldIndex[name] = i
+		}
+	}
+	for j, id := range newIDs {
+		if usedNew[j] || id == "" {
+			continue
+		}
+		if i, ok := oldIndex[idName(id)]; ok && !usedOld[i] {
+			pairs = append(pairs, [2]int{i, j})
+			usedOld[i], usedNew[j] = true, true
+		}
+	}
+
+	for i := range oldNames {
+		if !usedOld[i] {
+			removed = append(removed, i)
+		}
+	}
+	for j := range newNames {
+		if !usedNew[j] {
+			added = append(added, j)
+		}
+	}
+	return pairs, removed, added
+}
+
+// idName returns the name an entity ID ends with: the struct of
+// "pkg.Struct", the field or method of "pkg.Struct.Name".
+func idName(id string) string {
+	return id[strings.LastIndex(id, ".")+1:]
+}
+
+// namedField is one name of a field declaration; "a, b int" has two.
+type namedField struct {
+	field *ast.Field
+	name  string
+	typ   string
+}
+
+// applyFields makes the named fields of st match fields. The field list is
+// only rebuilt when they differ; embedded fields then keep their place among
+// the named ones, and fields keep their tag and comments.
+func applyFields(fset *token.FileSet, st *ast.StructType, fields []Field) (bool, error) {
+	// embedded[i] are the embedded fields declared after i named ones.
+	embedded := map[int][]*ast.Field{}
+	var named []namedField
+	for _, field := range st.Fields.List {
+		if len(field.Names) == 0 {
+			embedded[len(named)] = append(embedded[len(named)], field)
+			continue
+		}
+		typ := formatExpr(fset, field.Type)
+		for _, name := range field.Names {
+			named = append(named, namedField{field: field, name: name.Name, typ: typ})
+		}
+	}
+
+	same := len(named) == len(fields)
+	for i := 0; same && i < len(named); i++ {
+		same = named[i].name == fields[i].Name && named[i].typ == fields[i].Type.Literal
+	}
+	if same {
+		return false, nil
+	}
+
+	oldNames := make([]string, len(named))
+	for i, nf := range named {
+		oldNames[i] = nf.name
+	}
+	newNames := make([]string, len(fields))
+	newIDs := make([]string, len(fields))
+	for i, field := range fields {
+		newNames[i], newIDs[i] = field.Name, field.ID
+	}
+	pairs, _, _ := matchNames(oldNames, newNames, newIDs)
+	original := make([]*namedField, len(fields))
+	for _, pair := range pairs {
+		original[pair[1]] = &named[pair[0]]
+	}
+
+	var list []*ast.Field
+	for i, clientfield := range fields {
+		list = append(list, embedded[i]...)
+		orig := original[i]
+		if orig != nil && orig.name == clientfield.Name && orig.typ == clientfield.Type.Literal && len(orig.field.Names) == 1 {
+			list = append(list, orig.field)
+			continue
+		}
+
+		// A field declared alone is changed in place so that it keeps its
+		// position among the comments; one split off "a, b T" is new.
+		field := &ast.Field{Names: []*ast.Ident{ast.NewIdent(clientfield.Name)}}
+		if orig != nil && len(orig.field.Names) == 1 {
+			field = orig.field
+			field.Names[0].Name = clientfield.Name
+		} else if orig != nil {
+			field.Tag = orig.field.Tag
+		}
+		if orig != nil && orig.typ == clientfield.Type.Literal {
+			field.Type = orig.field.Type
+		} else {
+			fieldType, err := parseType(clientfield.Type.Literal)
+			if err != nil {
+				return false, fmt.Errorf("error parsing type of field %s: %w", clientfield.Name, err)
+			}
+			field.Type = fieldType
+		}
+		list = append(list, field)
+	}
+	for i := len(fields); i <= len(named); i++ {
+		list = append(list, embedded[i]...)
+	}
+	old := st.Fields.List
+	st.Fields.List = list
+	if n := len(old); n > 0 && (len(list) == 0 || list[len(list)-1] != old[n-1]) {
+		closeFields(st.Fields, old[n-1])
+	}
+	placeFields(st.Fields)
+	return true, nil
+}
+
+// placeFields gives new fields, which have no position, the position of
+// the next field or of the closing brace, so that the printer puts the
+// comments of the fields around them in their place.
+func placeFields(list *ast.FieldList) {
+	next := list.Closing
+	for i := len(list.List) - 1; i >= 0; i-- {
+		field := list.List[i]
+		if !field.Pos().IsValid() && len(field.Names) > 0 {
+			field.Names[0].NamePos = next
+		}
+		if field.Pos().IsValid() {
+			next = field.Pos()
+		}
+	}
+}
+
+// closeFields moves the closing brace of a field list up to the end of its
+// former last field, or onto the line of the opening brace when the list is
+// empty; the printer would otherwise keep a blank line for the field.
+func closeFields(list *ast.FieldList, last *ast.Field) {
+	switch {
+	case len(list.List) == 0:
+		list.Closing = list.Opening
+	case last.End().IsValid():
+		list.Closing = last.End()
+	}
+}
+
+// applyMethods makes the methods of a struct declared in f match the model:
+// it renames them, replaces changed parameter and result lists and deletes
+// the methods the model dropped. It returns stubs for the new ones, with the
+// receiver of the existing methods. Methods the model says are declared in
+// another file are not considered.
+func applyMethods(f *ast.File, clientstruct Struct, decls []*ast.FuncDecl) (bool, []ast.Decl, error) {
+	var methods []Method
+	for _, method := range clientstruct.Methods {
+		if method.File == "" {
+			methods = append(methods, method)
+		}
+	}
+	oldNames := make([]string, len(decls))
+	for i, decl := range decls {
+		oldNames[i] = decl.Name.Name
+	}
+	newNames := make([]string, len(methods))
+	newIDs := make([]string, len(methods))
+	for i, method := range methods {
+		newNames[i], newIDs[i] = method.Name, method.ID
+	}
+	pairs, removed, added := matchNames(oldNames, newNames, newIDs)
+
+	changed := false
+	for _, pair := range pairs {
+		decl, method := decls[pair[0]], methods[pair[1]]
+		if decl.Name.Name != method.Name {
+			decl.Name.Name = method.Name
+			changed = true
+		}
+		if method.Parameters != nil && !sameParameters(parseParameters(decl.Type.Params), method.Parameters) {
+			params, err := parameterList(method.Parameters)
+			if err != nil {
+				return false, nil, fmt.Errorf("method %s: %w", method.Name, err)
+			}
+			decl.Type.Params = params
+			changed = true
+		}
+		if method.ReturnType != nil && !sameTypes(parseReturnTypes(decl.Type.Results), method.ReturnType) {
+			results, err := resultList(method.ReturnType)
+			if err != nil {
+				return false, nil, fmt.Errorf("method %s: %w", method.Name, err)
+			}
+			decl.Type.Results = results
+			changed = true
+		}
+	}
+
+	var gone []*ast.FuncDecl
+	for _, i := range removed {
+		gone = append(gone, decls[i])
+	}
+	if len(gone) > 0 {
+		removeDecls(f, gone)
+		changed = true
+	}
+
+	recv := receiverField(clientstruct.Name, decls)
+	var stubs []ast.Decl
+	for _, i := range added {
+		stub, err := methodStub(recv, methods[i])
+		if err != nil {
+			return false, nil, err
+		}
+		stubs = append(stubs, stub)
+	}
+	return changed, stubs, nil
+}
+
+// receiverField returns the receiver for a new method of typeName: a
+// pointer, named as in the existing methods decls if there are any.
+func receiverField(typeName string, decls []*ast.FuncDecl) *ast.Field {
+	recv := &ast.Field{
+		Names: []*ast.Ident{ast.NewIdent(receiverIdent(typeName))},
+		Type:  &ast.StarExpr{X: ast.NewIdent(typeName)},
+	}
+	if len(decls) > 0 && len(decls[0].Recv.List[0].Names) > 0 {
+		recv.Names[0].Name = decls[0].Recv.List[0].Names[0].Name
+	}
+	return recv
+}
+
+// methodStub declares method on recv with a body that panics.
+func methodStub(recv *ast.Field, method Method) (*ast.FuncDecl, error) {
+	params, err := parameterList(method.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("method %s: %w", method.Name, err)
+	}
+	results, err := resultList(method.ReturnType)
+	if err != nil {
+		return nil, fmt.Errorf("method %s: %w", method.Name, err)
+	}
+	return &ast.FuncDecl{
+		Recv: &ast.FieldList{List: []*ast.Field{recv}},
+		Name: ast.NewIdent(method.Name),
+		Type: &ast.FuncType{Params: params, Results: results},
+		Body: notImplementedBody(),
+	}, nil
+}
+
+// receiverIdent is the conventional receiver name for a type: its first
+// letter, lower-cased.
+func receiverIdent(typeName string) string {
+	for _, r := range typeName {
+		if r >= 'A' && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+		return string(r)
+	}
+	return "r"
+}
+
+// notImplementedBody is the body of a generated method stub.
+func notImplementedBody() *ast.BlockStmt {
+	return &ast.BlockStmt{List: []ast.Stmt{
+		&ast.ExprStmt{X: &ast.CallExpr{
+			Fun:  ast.NewIdent("panic"),
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"not implemented"`}},
+		}},
+	}}
+}
+
+func sameParameters(a, b []Parameter) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type.Literal != b[i].Type.Literal {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTypes(a, b []Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Literal != b[i].Literal {
+			return false
+		}
+	}
+	return true
+}
+
+func parameterList(params []Parameter) (*ast.FieldList, error) {
+	list := &ast.FieldList{}
+	for _, param := range params {
+		typ, err := parseType(param.Type.Literal)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing parameter type: %w", err)
+		}
+		field := &ast.Field{Type: typ}
+		if param.Name != "" {
+			field.Names = []*ast.Ident{ast.NewIdent(param.Name)}
+		}
+		list.List = append(list.List, field)
+	}
+	return list, nil
+}
+
+func resultList(results []Type) (*ast.FieldList, error) {
+	if len(results) == 0 {
+		return nil, nil
+	}
+	list := &ast.FieldList{}
+	for _, result := range results {
+		typ, err := parseType(result.Literal)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing return type: %w", err)
+		}
+		list.List = append(list.List, &ast.Field{Type: typ})
+	}
+	return list, nil
+}
+
+// methodDecls returns the methods declared in f on the named type.
+func methodDecls(f *ast.File, typeName string) []*ast.FuncDecl {
+	var decls []*ast.FuncDecl
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if ok && fd.Recv != nil && len(fd.Recv.List) > 0 && receiverName(fd.Recv.List[0].Type) == typeName {
+			decls = append(decls, fd)
+		}
+	}
+	return decls
+}
+
+// renameReceiver replaces the type name in a receiver type, keeping the
+// pointer and type parameters.
+func renameReceiver(expr ast.Expr, name string) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		t.Name = name
+	case *ast.StarExpr:
+		renameReceiver(t.X, name)
+	case *ast.ParenExpr:
+		renameReceiver(t.X, name)
+	case *ast.IndexExpr:
+		renameReceiver(t.X, name)
+	case *ast.IndexListExpr:
+		renameReceiver(t.X, name)
+	}
+}
+
+func removeDecls(f *ast.File, gone []*ast.FuncDecl) {
+	drop := map[ast.Decl]bool{}
+	for _, decl := range gone {
+		drop[decl] = true
+	}
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		if !drop[decl] {
+			decls = append(decls, decl)
+		}
+	}
+	f.Decls = decls
+}
+
+// removeTypeSpec deletes a type spec, and its declaration once empty.
+func removeTypeSpec(f *ast.File, ts *ast.TypeSpec) {
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+			specs := gen.Specs[:0]
+			for _, spec := range gen.Specs {
+				if spec != ts {
+					specs = append(specs, spec)
+				}
+			}
+			gen.Specs = specs
+			if len(specs) == 0 {
+				continue
+			}
+		}
+		decls = append(decls, decl)
+	}
+	f.Decls = decls
+}
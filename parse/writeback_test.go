@@ -0,0 +1,227 @@
+package parse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDir writes files, by slash-separated name, to a new directory and
+// parses it with a Parser.
+func writeDir(t *testing.T, files map[string]string) (string, *ClientStruct, *Parser) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewParser()
+	model, _, err := p.ParseDir(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, model, p
+}
+
+// renderModel renders the model after edit changes it, keyed by the
+// slash-separated names of the files relative to dir.
+func renderModel(t *testing.T, dir string, p *Parser, edit func(*ClientStruct)) map[string]string {
+	t.Helper()
+	cached, pkgs, err := p.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Edit a copy, as the server decodes one: the model shares slices with
+	// the cache of the parser.
+	data, err := json.Marshal(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var model *ClientStruct
+	if err := json.Unmarshal(data, &model); err != nil {
+		t.Fatal(err)
+	}
+	// The protocol names files relative to the root.
+	for i := range model.Packages {
+		files := model.Packages[i].Files
+		for j := range files {
+			rel, err := filepath.Rel(dir, files[j].Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[j].Name = filepath.ToSlash(rel)
+		}
+	}
+	edit(model)
+	edits, err := RenderClientPackages(pkgs, dir, model.Packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, e := range edits {
+		rel, err := filepath.Rel(dir, e.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[filepath.ToSlash(rel)] = string(e.New)
+	}
+	return contents
+}
+
+// findStruct returns the struct named name in the model.
+func findStruct(t *testing.T, model *ClientStruct, name string) *Struct {
+	t.Helper()
+	for i := range model.Packages {
+		for j := range model.Packages[i].Files {
+			structs := model.Packages[i].Files[j].Structs
+			for k := range structs {
+				if structs[k].Name == name {
+					return &structs[k]
+				}
+			}
+		}
+	}
+	t.Fatalf("no struct %s in the model", name)
+	return nil
+}
+
+func TestWriteBackMethodsInOtherFiles(t *testing.T) {
+	dir, model, p := writeDir(t, map[string]string{
+		"s.go": "package p\n\ntype S struct{ N int }\n\nfunc (s *S) Own() {}\n",
+		"m.go": "package p\n\nfunc (s *S) Get() int { return s.N }\n",
+	})
+	st := findStruct(t, model, "S")
+	if len(st.Methods) != 2 || st.Methods[1].Name != "Get" || !st.Methods[1].Pointer || !strings.HasSuffix(st.Methods[1].File, "m.go") {
+		t.Fatalf("methods of S = %+v", st.Methods)
+	}
+
+	// The unchanged model writes nothing.
+	if got := renderModel(t, dir, p, func(*ClientStruct) {}); len(got) != 0 {
+		t.Errorf("unchanged model rewrote %v", got)
+	}
+
+	// A method added in the model goes to the file of the struct; the one
+	// of m.go is neither stubbed again nor deleted.
+	got := renderModel(t, dir, p, func(model *ClientStruct) {
+		st := findStruct(t, model, "S")
+		st.Methods = append(st.Methods, Method{Name: "Set", Parameters: []Parameter{{Name: "n", Type: Type{Literal: "int"}}}})
+	})
+	if len(got) != 1 || !strings.Contains(got["s.go"], "func (s *S) Set(n int)") || strings.Contains(got["s.go"], "Get") {
+		t.Errorf("adding a method rendered %v", got)
+	}
+}
+
+func TestWriteBackRenames(t *testing.T) {
+	dir, model, p := writeDir(t, map[string]string{
+		"s.go": "package p\n\n// A is a.\ntype A struct {\n\tN int\n}\n\nfunc (a *A) Get() int { return a.N }\n",
+	})
+	if st := findStruct(t, model, "A"); st.ID == "" || st.Fields[0].ID == "" || st.Methods[0].ID == "" {
+		t.Fatalf("model of A has no IDs: %+v", st)
+	}
+
+	tests := []struct {
+		name      string
+		edit      func(st *Struct)
+		want, not []string
+	}{
+		{
+			name: "struct replaced",
+			edit: func(st *Struct) {
+				*st = Struct{Name: "B", Fields: []Field{{Name: "M", Type: Type{Literal: "string"}}}}
+			},
+			want: []string{"type B struct", "M string"},
+			not:  []string{"A is a", "type A", "Get", "N int"},
+		},
+		{
+			name: "struct renamed",
+			edit: func(st *Struct) { st.Name = "B" },
+			want: []string{"// A is a.\ntype B struct", "func (a *B) Get() int { return a.N }"},
+			not:  []string{"type A"},
+		},
+		{
+			name: "field replaced",
+			edit: func(st *Struct) {
+				st.Fields = []Field{{Name: "M", Type: Type{Literal: "string"}}}
+			},
+			want: []string{"M string"},
+			not:  []string{"N int"},
+		},
+		{
+			name: "field renamed",
+			edit: func(st *Struct) { st.Fields[0].Name = "M" },
+			want: []string{"M int"},
+			not:  []string{"N int"},
+		},
+		{
+			name: "method replaced",
+			edit: func(st *Struct) {
+				st.Methods = []Method{{Name: "Put", Pointer: true}}
+			},
+			want: []string{"func (a *A) Put()"},
+			not:  []string{"Get", "return a.N"},
+		},
+		{
+			name: "method renamed",
+			edit: func(st *Struct) { st.Methods[0].Name = "Value" },
+			want: []string{"func (a *A) Value() int { return a.N }"},
+			not:  []string{"Get"},
+		},
+	}
+	for _, test := range tests {
+		got := renderModel(t, dir, p, func(model *ClientStruct) {
+			test.edit(findStruct(t, model, "A"))
+		})["s.go"]
+		for _, s := range test.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("%s: %q missing from\n%s", test.name, s, got)
+			}
+		}
+		for _, s := range test.not {
+			if strings.Contains(got, s) {
+				t.Errorf("%s: %q left in\n%s", test.name, s, got)
+			}
+		}
+	}
+}
+
+func TestWriteBackVersions(t *testing.T) {
+	dir, model, p := writeDir(t, map[string]string{"s.go": "package p\n\ntype S struct{ N int }\n"})
+	current := model.Packages[0].Files[0].Version
+	_, pkgs, err := p.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(file File) error {
+		pkg := Package{ID: model.Packages[0].ID, Name: "p", Files: []File{file}}
+		_, err := RenderClientPackages(pkgs, dir, []Package{pkg})
+		return err
+	}
+	var conflict *ConflictError
+
+	if err := render(File{Name: "s.go", Version: current}); err != nil {
+		t.Errorf("current version: %v", err)
+	}
+	err = render(File{Name: "s.go", Version: "0123456789abcdef"})
+	if !errors.As(err, &conflict) || conflict.Version != current || conflict.File != filepath.Join(dir, "s.go") {
+		t.Errorf("stale version: got %v, want a conflict with version %s", err, current)
+	}
+
+	// A file with a version existed when the model was built; one that is
+	// gone now is not created again.
+	if err := render(File{Name: "t.go"}); err != nil {
+		t.Errorf("new file: %v", err)
+	}
+	err = render(File{Name: "t.go", Version: current})
+	if !errors.As(err, &conflict) || !conflict.Removed {
+		t.Errorf("new file with a version: got %v, want a conflict", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"goDiagram/gitfs"
+	"goDiagram/parse"
+)
+
+// ClientRequest is a control message from the client. Messages without a
+// type are diagram updates and are decoded as a parse.ClientStruct, as is the
+// body of a "preview" request; an "edit" request is an EditRequest.
+type ClientRequest struct {
+	Type     string `json:"type"`
+	Revision string `json:"revision"`
+
+	// From and To are the revisions compared by a "diff" request; an empty
+	// revision is the working tree.
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RefsMessage lists the refs of the repository containing dirName.
+type RefsMessage struct {
+	Refs []gitfs.Ref `json:"refs"`
+}
+
+// DiffMessage lists the changes between two revisions. It follows the model
+// of the To revision, on which the client highlights them.
+type DiffMessage struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Changes []parse.Change `json:"changes"`
+}
+
+// RevisionMessage tells a client which revision its diagram shows. An empty
+// revision is the working tree.
+type RevisionMessage struct {
+	Revision string `json:"revision"`
+	Commit   string `json:"commit,omitempty"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+var (
+	// revisionModels holds the models of commits already parsed; a commit
+	// never changes, so they are kept for the life of the server.
+	revisionModels   = make(map[gitfs.Hash]*parse.ClientStruct)
+	revisionModelsMu sync.Mutex
+)
+
+func (c *Connection) revision() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rev
+}
+
+func (c *Connection) setRevision(rev string) {
+	c.mu.Lock()
+	c.rev = rev
+	c.mu.Unlock()
+}
+
+// handleRequest answers a control message. It reports false for messages
+// that are not control messages.
+func (c *Connection) handleRequest(req ClientRequest, message json.RawMessage) bool {
+	switch req.Type {
+	case "":
+		return false
+	case "refs":
+		refs, err := listRefs()
+		if err != nil {
+			log.Printf("Error listing refs for client %s: %v", c.ws.RemoteAddr(), err)
+			c.send <- ClientError{Error: err.Error()}
+			return true
+		}
+		c.send <- RefsMessage{Refs: refs}
+	case "checkout":
+		c.checkout(req.Revision)
+	case "diff":
+		c.diff(req.From, req.To)
+	case "preview":
+		c.preview(message)
+	case "edit":
+		c.edit(message)
+	case "undo", "redo":
+		c.undo(req.Type)
+	default:
+		c.send <- ClientError{Error: fmt.Sprintf("unknown message type %q", req.Type)}
+	}
+	return true
+}
+
+// checkout switches the client to the diagram of rev, or back to the working
+// tree when rev is empty. Clients viewing a revision get no broadcasts.
+func (c *Connection) checkout(rev string) {
+	if rev == "" {
+		clientStruct, err := readFileIfModified()
+		if err != nil {
+			c.send <- ClientError{Error: err.Error()}
+			return
+		}
+		c.setRevision("")
+		c.send <- RevisionMessage{ReadOnly: readOnly()}
+		c.send <- ClearLayoutMessage{ClearLayout: true}
+		if clientStruct != nil {
+			c.send <- workingTreeModel(clientStruct)
+		}
+		return
+	}
+
+	clientStruct, commit, err := readRevision(rev)
+	if err != nil {
+		log.Printf("Error reading revision %s for client %s: %v", rev, c.ws.RemoteAddr(), err)
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	c.setRevision(rev)
+	c.send <- RevisionMessage{Revision: rev, Commit: commit.String(), ReadOnly: true}
+	c.send <- ClearLayoutMessage{ClearLayout: true}
+	c.send <- ModelMessage{ClientStruct: clientStruct, ReadOnly: true}
+	log.Printf("Client %s switched to revision %s (%s)", c.ws.RemoteAddr(), rev, commit)
+}
+
+// diff shows the client the model of to with the changes since from
+// highlighted. Like a revision, the diff view is read-only and gets no
+// broadcasts until the client checks out the working tree again.
+func (c *Connection) diff(from, to string) {
+	oldModel, err := readSide(from)
+	if err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	newModel, err := readSide(to)
+	if err != nil {
+		c.send <- ClientError{Error: err.Error()}
+		return
+	}
+	diff := parse.DiffModels(oldModel, newModel)
+
+	label := sideName(from) + ".." + sideName(to)
+	c.setRevision(label)
+	c.send <- RevisionMessage{Revision: label, ReadOnly: true}
+	c.send <- ClearLayoutMessage{ClearLayout: true}
+	if newModel != nil {
+		c.send <- ModelMessage{ClientStruct: newModel, ReadOnly: true}
+	}
+	c.send <- DiffMessage{From: from, To: to, Changes: diff.Changes}
+	log.Printf("Client %s compared %s with %d change(s)", c.ws.RemoteAddr(), label, len(diff.Changes))
+}
+
+// readSide returns the model of rev, or of the working tree when rev is
+// empty.
+func readSide(rev string) (*parse.ClientStruct, error) {
+	if rev == "" {
+		return readFileIfModified()
+	}
+	clientStruct, _, err := readRevision(rev)
+	return clientStruct, err
+}
+
+func sideName(rev string) string {
+	if rev == "" {
+		return "working tree"
+	}
+	return rev
+}
+
+func openRepo() (*gitfs.Repo, error) {
+	if archiveFS != nil {
+		return nil, fmt.Errorf("revisions are not available for an archive")
+	}
+	return gitfs.Open(config.DirName)
+}
+
+func listRefs() ([]gitfs.Ref, error) {
+	repo, err := openRepo()
+	if err != nil {
+		return nil, err
+	}
+	return repo.Refs()
+}
+
+// readRevision parses dirName as it was at rev, reading the commit straight
+// from the object database.
+func readRevision(rev string) (*parse.ClientStruct, gitfs.Hash, error) {
+	repo, err := openRepo()
+	if err != nil {
+		return nil, gitfs.Hash{}, err
+	}
+	fsys, commit, err := repo.FS(rev)
+	if err != nil {
+		return nil, gitfs.Hash{}, err
+	}
+
+	revisionModelsMu.Lock()
+	defer revisionModelsMu.Unlock()
+	if clientStruct, ok := revisionModels[commit]; ok {
+		return clientStruct, commit, nil
+	}
+
+	root, err := repoRoot(repo, config.DirName)
+	if err != nil {
+		return nil, gitfs.Hash{}, err
+	}
+
+	p := parse.NewParser()
+	p.SetWorkers(config.Workers)
+	p.SetCacheDir(resolveCacheDir(config.CacheDir))
+	p.SetLogger(log.Default())
+	clientStruct, _, err := p.ParseFS(context.Background(), fsys, root)
+	if err != nil {
+		return nil, gitfs.Hash{}, fmt.Errorf("error parsing revision %s: %w", rev, err)
+	}
+	removeDuplicates(clientStruct)
+	revisionModels[commit] = clientStruct
+
+	return clientStruct, commit, nil
+}
+
+// repoRoot returns dir relative to the top of the working tree, in the
+// slash-separated form fs.FS expects.
+func repoRoot(repo *gitfs.Repo, dir string) (string, error) {
+	if repo.WorkTree() == "" {
+		return ".", nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(repo.WorkTree(), abs)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside the repository", dir)
+	}
+	return rel, nil
+}
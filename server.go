@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"go/ast"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -34,20 +44,38 @@ type ClearLayoutMessage struct {
 	ClearLayout bool `json:"clearLayout"`
 }
 
+// ModelMessage is a model as sent to clients. ReadOnly tells the client that
+// the diagram it shows cannot be edited: the server is read-only, or the
+// model is that of an archive or a past revision.
+type ModelMessage struct {
+	*parse.ClientStruct
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// workingTreeModel returns the message for a model of the working tree.
+func workingTreeModel(clientStruct *parse.ClientStruct) ModelMessage {
+	return ModelMessage{ClientStruct: clientStruct, ReadOnly: readOnly()}
+}
+
 type Config struct {
 	Addr              string `json:"addr"`
 	DirName           string `json:"dirName"`
 	DebounceInterval  string `json:"debounceInterval"`
 	ConfigCheckPeriod string `json:"configCheckPeriod"`
+	Workers           int    `json:"workers"`
+	CacheDir          string `json:"cacheDir"`
+	// ReadOnly refuses every edit, for diagrams shared as documentation.
+	ReadOnly bool `json:"readOnly"`
+	// AllowedOrigins are the origins, such as "https://diagram.example.com",
+	// that may connect to the WebSocket besides the server itself.
+	AllowedOrigins []string `json:"allowedOrigins"`
 }
 
 var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     checkOrigin,
 	}
 
 	clients   = make(map[*Connection]bool)
@@ -59,6 +87,9 @@ var (
 	pkgs       map[string]*ast.Package
 	pkgsMu     sync.RWMutex
 
+	modelParser = parse.NewParser()
+	journal     = parse.NewJournal(100)
+
 	lastModTime      time.Time
 	lastClientStruct *parse.ClientStruct
 	fileMutex        sync.RWMutex
@@ -67,15 +98,30 @@ var (
 
 	debounceIntervalDuration  time.Duration
 	configCheckPeriodDuration time.Duration
+
+	// sessionToken authenticates WebSocket clients. It is generated at
+	// startup and handed to the browser in the URL openBrowser opens.
+	sessionToken string
+
+	archivePath  = flag.String("archive", "", "diagram a .zip, .tar or .tar.gz archive instead of dirName (read-only)")
+	readOnlyFlag = flag.Bool("readonly", false, "refuse all edits, like the readOnly setting")
+	archiveFS    fs.FS
 )
 
 type ClientError struct {
-	Error string `json:"error"`
+	Error       string             `json:"error"`
+	Diagnostics []parse.Diagnostic `json:"diagnostics,omitempty"`
+	// Conflict is the current state of a file an edit was refused for,
+	// because the client's version of it is outdated.
+	Conflict *parse.File `json:"conflict,omitempty"`
 }
 
 type Connection struct {
 	ws   *websocket.Conn
 	send chan interface{}
+
+	mu  sync.Mutex
+	rev string // revision being viewed; "" for the working tree
 }
 
 func (c *Connection) reader(ctx context.Context) {
@@ -115,6 +161,11 @@ func (c *Connection) reader(ctx context.Context) {
 				return
 			}
 
+			var req ClientRequest
+			if err := json.Unmarshal(message, &req); err == nil && c.handleRequest(req, message) {
+				continue
+			}
+
 			var clientStruct parse.ClientStruct
 			if err := json.Unmarshal(message, &clientStruct); err != nil {
 				log.Printf("Error unmarshaling JSON from client %s: %v", c.ws.RemoteAddr(), err)
@@ -122,14 +173,7 @@ func (c *Connection) reader(ctx context.Context) {
 				continue
 			}
 
-			pkgsMu.Lock()
-			err := parse.WriteClientPackages(pkgs, clientStruct.Packages)
-			pkgsMu.Unlock()
-			if err != nil {
-				log.Printf("Error writing client packages: %v", err)
-				c.send <- ClientError{Error: err.Error()}
-			}
-			log.Printf("Processed update from client %s", c.ws.RemoteAddr())
+			c.apply(clientStruct)
 		}
 	}
 }
@@ -181,7 +225,49 @@ func (c *Connection) writer(ctx context.Context) {
 	}
 }
 
+// newSessionToken returns a random token for sessionToken.
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkOrigin accepts WebSocket handshakes from pages of the server itself,
+// on a loopback address and its port, and from config.AllowedOrigins. The
+// Host header is not trusted: DNS rebinding lets any page choose it.
+// Requests without an Origin header do not come from a browser; like the
+// others, they still need the token.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range config.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(config.Addr)
+	if err != nil || u.Port() != port {
+		return false
+	}
+	host := u.Hostname()
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
 func serveWs(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(sessionToken)) != 1 {
+		log.Printf("Refused WebSocket connection from %s: invalid token", r.RemoteAddr)
+		http.Error(w, "invalid or missing token", http.StatusForbidden)
+		return
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -202,7 +288,7 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error reading initial file: %v", err)
 		conn.send <- ClientError{Error: err.Error()}
 	} else if clientStruct != nil {
-		conn.send <- clientStruct
+		conn.send <- workingTreeModel(clientStruct)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -216,6 +302,10 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 func readFileIfModified() (*parse.ClientStruct, error) {
+	if archiveFS != nil {
+		return readArchive()
+	}
+
 	fileMutex.RLock()
 	defer fileMutex.RUnlock()
 
@@ -256,13 +346,14 @@ func readFileIfModified() (*parse.ClientStruct, error) {
 		return lastClientStruct, nil
 	}
 
-	clientStruct, newPkgs, err := parse.GetStructsDirName(config.DirName)
+	clientStruct, newPkgs, err := modelParser.ParseDir(context.Background(), config.DirName)
 	if err != nil {
 		return nil, err
 	}
 
 	// 删除重复的包、结构和方法
 	removeDuplicates(clientStruct)
+	relativeNames(clientStruct)
 
 	pkgsMu.Lock()
 	pkgs = newPkgs
@@ -277,57 +368,110 @@ func readFileIfModified() (*parse.ClientStruct, error) {
 	return clientStruct, nil
 }
 
+// readArchive parses archiveFS once; an archive never changes.
+func readArchive() (*parse.ClientStruct, error) {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if lastClientStruct != nil {
+		return lastClientStruct, nil
+	}
+
+	clientStruct, _, err := modelParser.ParseFS(context.Background(), archiveFS, ".")
+	if err != nil {
+		return nil, err
+	}
+	removeDuplicates(clientStruct)
+	lastClientStruct = clientStruct
+
+	log.Printf("Loaded archive %s with %d packages, %d edges",
+		*archivePath, len(clientStruct.Packages), len(clientStruct.Edges))
+
+	return clientStruct, nil
+}
+
+// relativeNames rewrites the file names of a freshly parsed model relative
+// to dirName, as the protocol has them; the parser names files by their path
+// on disk.
+func relativeNames(clientStruct *parse.ClientStruct) {
+	for i := range clientStruct.Packages {
+		files := clientStruct.Packages[i].Files
+		for j := range files {
+			files[j].Name = displayName(files[j].Name)
+			for _, st := range files[j].Structs {
+				for k := range st.Methods {
+					if st.Methods[k].File != "" {
+						st.Methods[k].File = displayName(st.Methods[k].File)
+					}
+				}
+			}
+		}
+	}
+	for _, edge := range clientStruct.Edges {
+		edge.From.FileName = displayName(edge.From.FileName)
+		edge.To.FileName = displayName(edge.To.FileName)
+	}
+	for i := range clientStruct.GlobalFunctions {
+		clientStruct.GlobalFunctions[i].File = displayName(clientStruct.GlobalFunctions[i].File)
+	}
+	for i := range clientStruct.Diagnostics {
+		if clientStruct.Diagnostics[i].File != "" {
+			clientStruct.Diagnostics[i].File = displayName(clientStruct.Diagnostics[i].File)
+		}
+	}
+}
+
 func removeDuplicates(clientStruct *parse.ClientStruct) {
-	// 去重包
-	pkgMap := make(map[string]*parse.Package)
+	// 去重包. Keep the first occurrence so the order stays deterministic.
+	// Packages of the same name in different directories are distinct.
+	seenPkgs := make(map[string]bool)
+	packages := make([]parse.Package, 0, len(clientStruct.Packages))
 	for _, pkg := range clientStruct.Packages {
-		if _, exists := pkgMap[pkg.Name]; !exists {
-			pkgMap[pkg.Name] = &pkg
+		if seenPkgs[pkg.ID] {
+			continue
 		}
+		seenPkgs[pkg.ID] = true
+		packages = append(packages, pkg)
 	}
-	clientStruct.Packages = make([]parse.Package, 0, len(pkgMap))
-	for _, pkg := range pkgMap {
-		clientStruct.Packages = append(clientStruct.Packages, *pkg)
-	}
+	clientStruct.Packages = packages
 
 	// 去重结构和方法
 	for i := range clientStruct.Packages {
 		pkg := &clientStruct.Packages[i]
-		fileMap := make(map[string]*parse.File)
+		seenFiles := make(map[string]bool)
+		files := make([]parse.File, 0, len(pkg.Files))
 		for _, file := range pkg.Files {
-			if _, exists := fileMap[file.Name]; !exists {
-				fileMap[file.Name] = &file
+			if seenFiles[file.Name] {
+				continue
 			}
-		}
-		pkg.Files = make([]parse.File, 0, len(fileMap))
-		for _, file := range fileMap {
-			pkg.Files = append(pkg.Files, *file)
+			seenFiles[file.Name] = true
 
 			// 去重结构
-			structMap := make(map[string]*parse.Struct)
+			seenStructs := make(map[string]bool)
+			structs := make([]parse.Struct, 0, len(file.Structs))
 			for _, st := range file.Structs {
-				if _, exists := structMap[st.Name]; !exists {
-					structMap[st.Name] = &st
+				if seenStructs[st.Name] {
+					continue
 				}
-			}
-			file.Structs = make([]parse.Struct, 0, len(structMap))
-			for _, st := range structMap {
-				file.Structs = append(file.Structs, *st)
+				seenStructs[st.Name] = true
 
 				// 去重方法
-				methodMap := make(map[string]*parse.Method)
+				seenMethods := make(map[string]bool)
+				methods := make([]parse.Method, 0, len(st.Methods))
 				for _, m := range st.Methods {
-					key := fmt.Sprintf("%s:%s", st.Name, m.Name)
-					if _, exists := methodMap[key]; !exists {
-						methodMap[key] = &m
+					if seenMethods[m.Name] {
+						continue
 					}
+					seenMethods[m.Name] = true
+					methods = append(methods, m)
 				}
-				st.Methods = make([]parse.Method, 0, len(methodMap))
-				for _, m := range methodMap {
-					st.Methods = append(st.Methods, *m)
-				}
+				st.Methods = methods
+				structs = append(structs, st)
 			}
+			file.Structs = structs
+			files = append(files, file)
 		}
+		pkg.Files = files
 	}
 }
 
@@ -344,6 +488,7 @@ func watchFiles(broadcast chan<- interface{}) {
 	}(watcher)
 
 	var timer *time.Timer
+	var cancelUpdate context.CancelFunc
 
 	done := make(chan bool)
 	go func() {
@@ -353,14 +498,24 @@ func watchFiles(broadcast chan<- interface{}) {
 				if !ok {
 					return
 				}
-				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove) != 0 {
+				// A rename reports the old name, which Refresh drops; the new
+				// one comes as a Create.
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
 					log.Println("modified file:", event.Name)
+					modelParser.Invalidate(event.Name)
 
 					if timer != nil {
 						timer.Stop()
 					}
+					// A newer change makes any parse still in flight stale.
+					if cancelUpdate != nil {
+						cancelUpdate()
+					}
+					ctx, cancel := context.WithCancel(context.Background())
+					cancelUpdate = cancel
 					timer = time.AfterFunc(debounceIntervalDuration, func() {
-						updateAndBroadcast(broadcast)
+						defer cancel()
+						updateAndBroadcast(ctx, broadcast)
 					})
 				}
 			case err, ok := <-watcher.Errors:
@@ -387,160 +542,90 @@ func watchFiles(broadcast chan<- interface{}) {
 	<-done
 }
 
-func updateAndBroadcast(broadcast chan<- interface{}) {
-	// Отправляем сообщение для очистки layout
-	broadcast <- ClearLayoutMessage{ClearLayout: true}
-
-	clientStruct, newPkgs, err := parse.GetStructsDirName(config.DirName)
+func updateAndBroadcast(ctx context.Context, broadcast chan<- interface{}) {
+	clientStruct, newPkgs, err := modelParser.Refresh(ctx)
+	if errors.Is(err, context.Canceled) {
+		log.Println("Update cancelled by a newer change")
+		return
+	}
 	if err != nil {
 		log.Printf("Error updating structure: %v", err)
 		return
 	}
+	removeDuplicates(clientStruct)
 
-	pkgsMu.Lock()
-	defer pkgsMu.Unlock()
-
-	if hasChanges(pkgs, newPkgs) {
-		pkgs = newPkgs
-
-		// Удаляем дублирующиеся структуры из main пакета
-		mainPkg := findMainPackage(clientStruct)
-		if mainPkg != nil {
-			oldMainFileCount := len(mainPkg.Files)
-			for i, file := range mainPkg.Files {
-				if file.Name == "main.go" {
-					mainPkg.Files = append(mainPkg.Files[:i], mainPkg.Files[i+1:]...)
-					break
-				}
+	// Удаляем дублирующиеся структуры из main пакета
+	mainPkg := findMainPackage(clientStruct)
+	if mainPkg != nil {
+		oldMainFileCount := len(mainPkg.Files)
+		for i, file := range mainPkg.Files {
+			if file.Name == "main.go" {
+				mainPkg.Files = append(mainPkg.Files[:i], mainPkg.Files[i+1:]...)
+				break
 			}
-			newMainFileCount := len(mainPkg.Files)
-			log.Printf("Removed %d duplicate main.go file(s) from main package", oldMainFileCount-newMainFileCount)
-		}
-
-		b, err := json.Marshal(clientStruct)
-		if err != nil {
-			log.Printf("Error marshaling ClientStruct: %v", err)
-			return
 		}
-		log.Printf("Broadcasting updated structure: %s", b)
-
-		broadcast <- clientStruct
-		log.Printf("Broadcasted updated structure with %d packages, %d edges",
-			len(clientStruct.Packages), len(clientStruct.Edges))
-	} else {
-		log.Println("No changes detected, skipping broadcast")
+		newMainFileCount := len(mainPkg.Files)
+		log.Printf("Removed %d duplicate main.go file(s) from main package", oldMainFileCount-newMainFileCount)
 	}
-}
+	relativeNames(clientStruct)
 
-func findMainPackage(clientStruct *parse.ClientStruct) *parse.Package {
-	for i, pkg := range clientStruct.Packages {
-		if pkg.Name == "main" {
-			return &clientStruct.Packages[i]
-		}
+	fileMutex.Lock()
+	changed, err := modelChanged(lastClientStruct, clientStruct)
+	if err != nil {
+		fileMutex.Unlock()
+		log.Printf("Error comparing structures: %v", err)
+		return
 	}
-	return nil
-}
-func hasChanges(oldPkgs, newPkgs map[string]*ast.Package) bool {
-	if len(oldPkgs) != len(newPkgs) {
-		return true
+	if changed {
+		lastClientStruct = clientStruct
 	}
+	fileMutex.Unlock()
 
-	for name, oldPkg := range oldPkgs {
-		newPkg, exists := newPkgs[name]
-		if !exists {
-			return true
-		}
-
-		if len(oldPkg.Files) != len(newPkg.Files) {
-			return true
-		}
+	if !changed {
+		log.Println("No changes detected, skipping broadcast")
+		return
+	}
 
-		for fileName, oldFile := range oldPkg.Files {
-			newFile, exists := newPkg.Files[fileName]
-			if !exists {
-				return true
-			}
+	pkgsMu.Lock()
+	pkgs = newPkgs
+	pkgsMu.Unlock()
 
-			if !compareAST(oldFile, newFile) {
-				return true
-			}
-		}
+	if len(clientStruct.Diagnostics) > 0 {
+		log.Printf("Parsed with %d diagnostic(s)", len(clientStruct.Diagnostics))
 	}
 
-	return false
+	// Отправляем сообщение для очистки layout
+	broadcast <- ClearLayoutMessage{ClearLayout: true}
+	broadcast <- workingTreeModel(clientStruct)
+	log.Printf("Broadcasted updated structure with %d packages, %d edges",
+		len(clientStruct.Packages), len(clientStruct.Edges))
 }
 
-func compareAST(oldFile, newFile *ast.File) bool {
-	oldStructs := make(map[string]*ast.StructType)
-	newStructs := make(map[string]*ast.StructType)
-
-	ast.Inspect(oldFile, func(n ast.Node) bool {
-		if ts, ok := n.(*ast.TypeSpec); ok {
-			if st, ok := ts.Type.(*ast.StructType); ok {
-				oldStructs[ts.Name.Name] = st
-			}
-		}
-		return true
-	})
-
-	ast.Inspect(newFile, func(n ast.Node) bool {
-		if ts, ok := n.(*ast.TypeSpec); ok {
-			if st, ok := ts.Type.(*ast.StructType); ok {
-				newStructs[ts.Name.Name] = st
-			}
-		}
-		return true
-	})
-
-	if len(oldStructs) != len(newStructs) {
-		return false
+// modelChanged compares two models by their JSON encoding, which is
+// deterministic for an unchanged source tree.
+func modelChanged(oldStruct, newStruct *parse.ClientStruct) (bool, error) {
+	if oldStruct == nil {
+		return true, nil
 	}
-
-	for name, oldStruct := range oldStructs {
-		newStruct, exists := newStructs[name]
-		if !exists {
-			return false
-		}
-
-		if !compareStructs(oldStruct, newStruct) {
-			return false
-		}
+	oldJSON, err := json.Marshal(oldStruct)
+	if err != nil {
+		return false, err
 	}
-
-	return true
-}
-
-func compareStructs(oldStruct, newStruct *ast.StructType) bool {
-	if len(oldStruct.Fields.List) != len(newStruct.Fields.List) {
-		return false
+	newJSON, err := json.Marshal(newStruct)
+	if err != nil {
+		return false, err
 	}
+	return !bytes.Equal(oldJSON, newJSON), nil
+}
 
-	for i, oldField := range oldStruct.Fields.List {
-		newField := newStruct.Fields.List[i]
-
-		if len(oldField.Names) != len(newField.Names) {
-			return false
-		}
-
-		for j, oldName := range oldField.Names {
-			if oldName.Name != newField.Names[j].Name {
-				return false
-			}
-		}
-
-		if !compareExpr(oldField.Type, newField.Type) {
-			return false
+func findMainPackage(clientStruct *parse.ClientStruct) *parse.Package {
+	for i, pkg := range clientStruct.Packages {
+		if pkg.Name == "main" {
+			return &clientStruct.Packages[i]
 		}
 	}
-
-	return true
-}
-
-func compareExpr(oldExpr, newExpr ast.Expr) bool {
-	return fmt.Sprintf("%T", oldExpr) == fmt.Sprintf("%T", newExpr) &&
-		fmt.Sprint(oldExpr) == fmt.Sprint(newExpr)
+	return nil
 }
-
 func loadConfig() error {
 	file, err := os.ReadFile(configPath)
 	if err != nil {
@@ -566,10 +651,29 @@ func loadConfig() error {
 	config = rawConfig
 	debounceIntervalDuration = debounceInterval
 	configCheckPeriodDuration = configCheckPeriod
+	modelParser.SetWorkers(config.Workers)
+	modelParser.SetCacheDir(resolveCacheDir(config.CacheDir))
 
 	return nil
 }
 
+// resolveCacheDir returns the directory for the persistent model cache.
+// An empty setting means the user cache directory; "off" disables it.
+func resolveCacheDir(dir string) string {
+	switch dir {
+	case "off":
+		return ""
+	case "":
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			log.Printf("Persistent cache disabled: %v", err)
+			return ""
+		}
+		return filepath.Join(userCacheDir, "go-diagram")
+	}
+	return dir
+}
+
 func watchConfig() {
 	ticker := time.NewTicker(configCheckPeriodDuration)
 	defer ticker.Stop()
@@ -590,7 +694,7 @@ func watchConfig() {
 				continue
 			}
 
-			if newConfig != config {
+			if !reflect.DeepEqual(newConfig, config) {
 				log.Printf("Config changed, updating...")
 
 				oldConfig := config
@@ -608,6 +712,19 @@ func watchConfig() {
 					continue
 				}
 
+				if oldConfig.Workers != config.Workers {
+					modelParser.SetWorkers(config.Workers)
+				}
+
+				if oldConfig.CacheDir != config.CacheDir {
+					modelParser.SetCacheDir(resolveCacheDir(config.CacheDir))
+				}
+
+				if oldConfig.ReadOnly != config.ReadOnly && lastClientStruct != nil {
+					log.Printf("Read-only mode is now %v", readOnly())
+					broadcast <- workingTreeModel(lastClientStruct)
+				}
+
 				if oldConfig.Addr != config.Addr {
 					log.Println("Server address changed, restart required")
 					// Здесь можно добавить логику для перезапуска сервера, если это необходимо
@@ -632,7 +749,7 @@ func watchConfig() {
 					if err != nil {
 						log.Printf("Error reading new directory: %v", err)
 					} else if clientStruct != nil {
-						broadcast <- clientStruct
+						broadcast <- workingTreeModel(clientStruct)
 					}
 				}
 			}
@@ -641,7 +758,18 @@ func watchConfig() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			os.Exit(runDiff(os.Args[2:], os.Stdout, os.Stderr))
+		case "apidiff":
+			os.Exit(runAPIDiff(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	modelParser.SetLogger(log.Default())
 
 	err := loadConfig()
 	if err != nil {
@@ -650,13 +778,37 @@ func main() {
 
 	log.Printf("Starting server with configuration: %+v", config)
 
-	go watchFiles(broadcast)
+	sessionToken, err = newSessionToken()
+	if err != nil {
+		log.Fatalf("Error generating session token: %v", err)
+	}
+
+	if *archivePath != "" {
+		fsys, closer, err := parse.OpenArchive(*archivePath)
+		if err != nil {
+			log.Fatalf("Error opening archive: %v", err)
+		}
+		defer closer.Close()
+		archiveFS = fsys
+	}
+
+	if _, err := readFileIfModified(); err != nil {
+		log.Printf("Error reading initial structure: %v", err)
+	}
+
+	if archiveFS == nil {
+		go watchFiles(broadcast)
+	}
 	go watchConfig()
 
 	go func() {
 		for msg := range broadcast {
 			clientsMu.Lock()
 			for client := range clients {
+				// Clients looking at a past revision keep their diagram.
+				if client.revision() != "" {
+					continue
+				}
 				select {
 				case client.send <- msg:
 				default:
@@ -683,7 +835,9 @@ func main() {
 		}
 	}()
 
-	openBrowser(fmt.Sprintf("http://localhost%s", config.Addr))
+	appURL := fmt.Sprintf("http://localhost%s/?token=%s", config.Addr, sessionToken)
+	log.Printf("Open %s to view the diagram", appURL)
+	openBrowser(appURL)
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// testServer serves the WebSocket endpoint on a loopback port, with
+// config.Addr set to that port and a diagram of a one-file package.
+func testServer(t *testing.T) (wsURL, port string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n\ntype S struct{ N int }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(serveWs))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldToken := config, sessionToken
+	t.Cleanup(func() { config, sessionToken = oldConfig, oldToken })
+	config = Config{
+		Addr:           ":" + u.Port(),
+		DirName:        dir,
+		AllowedOrigins: []string{"https://diagram.example.com/"},
+	}
+	sessionToken = "secret"
+	return "ws://" + u.Host + "/ws", u.Port()
+}
+
+func TestCheckOrigin(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = Config{Addr: ":5874", AllowedOrigins: []string{"https://diagram.example.com/"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		// Not a browser; the token still decides.
+		{"", true},
+		{"http://localhost:5874", true},
+		{"http://127.0.0.1:5874", true},
+		{"http://127.0.0.2:5874", true},
+		{"http://[::1]:5874", true},
+		{"https://diagram.example.com", true},
+		{"HTTPS://Diagram.Example.com", true},
+		{"http://localhost:3000", false},
+		{"http://127.0.0.1:3000", false},
+		{"http://localhost", false},
+		{"https://localhost:5874", false},
+		{"http://evil.example.com:5874", false},
+		{"http://localhost.evil.example.com:5874", false},
+		{"http://192.168.1.10:5874", false},
+		{"https://diagram.example.com:8443", false},
+		{"https://evil.diagram.example.com", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := checkOrigin(r); got != test.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", test.origin, got, test.want)
+		}
+	}
+}
+
+func TestServeWsRefused(t *testing.T) {
+	wsURL, port := testServer(t)
+	tests := []struct {
+		name, token, origin string
+	}{
+		{name: "missing token", origin: "http://localhost:" + port},
+		{name: "wrong token", token: "secreT", origin: "http://localhost:" + port},
+		{name: "token prefix", token: "secre", origin: "http://localhost:" + port},
+		{name: "foreign origin", token: "secret", origin: "http://evil.example.com:" + port},
+		{name: "loopback origin on another port", token: "secret", origin: "http://localhost:" + otherPort(port)},
+	}
+	for _, test := range tests {
+		header := http.Header{"Origin": {test.origin}}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+"?token="+url.QueryEscape(test.token), header)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connection accepted", test.name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %v, want 403 Forbidden", test.name, err)
+		}
+	}
+}
+
+func TestServeWsAccepted(t *testing.T) {
+	wsURL, port := testServer(t)
+	for _, origin := range []string{"", "http://localhost:" + port, "http://127.0.0.1:" + port, "https://diagram.example.com"} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=secret", header)
+		if err != nil {
+			t.Errorf("origin %q: %v", origin, err)
+			continue
+		}
+		// The server greets the client with the model.
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Errorf("origin %q: %v", origin, err)
+		} else if _, ok := msg["packages"]; !ok {
+			t.Errorf("origin %q: first message %v is not a model", origin, msg)
+		}
+		conn.Close()
+	}
+}
+
+// otherPort returns a port number other than port.
+func otherPort(port string) string {
+	if port == "3000" {
+		return "3001"
+	}
+	return "3000"
+}